@@ -0,0 +1,69 @@
+package httpassert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// On registers and returns an expectation for one call to method and path.
+// It can be refined by chaining the ExpectedCall builder methods, e.g.
+//
+//	s.On("GET", "/users").Times(2).RespondJSON(200, users)
+//
+// Like setting fields directly, the builder methods aren't safe to use while
+// the server is handling requests, so finish the chain before making calls.
+func (s *Server) On(method, path string) *ExpectedCall {
+	ec := &ExpectedCall{Method: method, Path: path, Calls: 1}
+	s.Expect(ec)
+	return ec
+}
+
+// Times sets the number of calls expected.
+func (ec *ExpectedCall) Times(n int) *ExpectedCall {
+	ec.Calls = n
+	return ec
+}
+
+// Respond sets a Handler which responds with code and body.
+func (ec *ExpectedCall) Respond(code int, body string) *ExpectedCall {
+	ec.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	})
+	return ec
+}
+
+// RespondJSON sets a Handler which responds with code and v encoded as JSON.
+// If v can't be encoded the response is a 500 with the error.
+func (ec *ExpectedCall) RespondJSON(code int, v interface{}) *ExpectedCall {
+	ec.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(b)
+	})
+	return ec
+}
+
+// WithHeader adds a header value the request must have.
+func (ec *ExpectedCall) WithHeader(key, value string) *ExpectedCall {
+	if ec.Header == nil {
+		ec.Header = make(http.Header)
+	}
+	ec.Header.Add(key, value)
+	return ec
+}
+
+// WithQuery adds a query value the request must have.
+func (ec *ExpectedCall) WithQuery(key, value string) *ExpectedCall {
+	if ec.Query == nil {
+		ec.Query = make(url.Values)
+	}
+	ec.Query.Add(key, value)
+	return ec
+}
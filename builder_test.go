@@ -0,0 +1,47 @@
+package httpassert
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestServerOn(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	users := []string{"alice", "bob"}
+	s.On("GET", "/users").Times(2).WithQuery("page", "1").WithHeader("Accept", "application/json").RespondJSON(200, users)
+	s.On("DELETE", "/users/1").Respond(204, "")
+	s.On("GET", "/health")
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", u+"/users?page=1", nil)
+		req.Header.Set("Accept", "application/json")
+		r, err := http.DefaultClient.Do(req)
+		assertResponse(t, 200, r, err)
+		var got []string
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil || len(got) != 2 {
+			t.Errorf("Expected users, got %v (%v)", got, err)
+		}
+	}
+	r, err := http.Get(u + "/users?page=2")
+	assertResponse(t, 404, r, err)
+
+	req, _ := http.NewRequest("DELETE", u+"/users/1", nil)
+	r, err = http.DefaultClient.Do(req)
+	assertResponse(t, 204, r, err)
+	if b, _ := io.ReadAll(r.Body); len(b) != 0 {
+		t.Errorf("Expected empty body, got (%s)", b)
+	}
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) expected (1) more calls to GET /health",
+		"Server(testserver) got (1) unexpected calls to GET /users",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
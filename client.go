@@ -0,0 +1,51 @@
+package httpassert
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// RecordingClient returns a client which records every request it sends before
+// performing it with http.DefaultTransport, and a func returning the recorded
+// requests. Recorded request bodies can be read after the request is sent.
+func RecordingClient() (*http.Client, func() []*http.Request) {
+	rt := &recordingTransport{RoundTripper: http.DefaultTransport}
+	return &http.Client{Transport: rt}, rt.requests
+}
+
+type recordingTransport struct {
+	http.RoundTripper
+
+	reqs []*http.Request
+	m    sync.Mutex
+}
+
+// RoundTrip implements http.RoundTripper
+func (rt *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rec := r.Clone(r.Context())
+	if r.Body != nil && r.Body != http.NoBody {
+		b, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r = r.Clone(r.Context())
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		rec.Body = io.NopCloser(bytes.NewReader(b))
+	}
+
+	rt.m.Lock()
+	rt.reqs = append(rt.reqs, rec)
+	rt.m.Unlock()
+
+	return rt.RoundTripper.RoundTrip(r)
+}
+
+func (rt *recordingTransport) requests() []*http.Request {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	return append([]*http.Request(nil), rt.reqs...)
+}
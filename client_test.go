@@ -0,0 +1,37 @@
+package httpassert
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRecordingClient(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.CatchAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+	}))
+
+	c, requests := RecordingClient()
+	r, err := c.Get(u + "/first")
+	assertResponse(t, 200, r, err)
+	r, err = c.Post(u+"/second", "text/plain", strings.NewReader("hello"))
+	assertResponse(t, 200, r, err)
+
+	reqs := requests()
+	if len(reqs) != 2 {
+		t.Fatalf("Expected (2) recorded requests, got (%d)", len(reqs))
+	}
+	if reqs[0].Method != "GET" || reqs[0].URL.Path != "/first" {
+		t.Errorf("Expected GET /first, got %s %s", reqs[0].Method, reqs[0].URL.Path)
+	}
+	b, _ := io.ReadAll(reqs[1].Body)
+	if reqs[1].Method != "POST" || reqs[1].URL.Path != "/second" || string(b) != "hello" {
+		t.Errorf("Expected POST /second hello, got %s %s %s", reqs[1].Method, reqs[1].URL.Path, b)
+	}
+	if got := s.Log().Count("POST", "/second"); got != 1 {
+		t.Errorf("Expected server to receive POST /second, got (%d)", got)
+	}
+}
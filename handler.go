@@ -0,0 +1,211 @@
+package httpassert
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// MirrorHeaders returns a handler which copies request headers starting with
+// prefix into the response and responds 200. An empty prefix copies all
+// headers. The prefix is compared case insensitively.
+func MirrorHeaders(prefix string) http.Handler {
+	prefix = strings.ToLower(prefix)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, vs := range r.Header {
+			if !strings.HasPrefix(strings.ToLower(k), prefix) {
+				continue
+			}
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Stream returns a handler which copies src to the response, flushing after
+// each chunk so the response is sent chunked. Copying stops early if the
+// request context is canceled. Since src is consumed, the handler should only
+// be used for a single call.
+func Stream(src io.Reader, contentType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+
+		rc := http.NewResponseController(w)
+		buf := make([]byte, 32*1024)
+		for r.Context().Err() == nil {
+			n, err := src.Read(buf)
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return
+				}
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+// AssertRequest returns a handler which runs each check against the request,
+// reporting failures with t.Errorf. It responds 200, or 400 if any check
+// failed.
+func AssertRequest(t testing.TB, checks ...func(*http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Helper()
+
+		code := http.StatusOK
+		for _, check := range checks {
+			if err := check(r); err != nil {
+				t.Errorf("%s %s failed check: %v", r.Method, r.URL.Path, err)
+				code = http.StatusBadRequest
+			}
+		}
+		w.WriteHeader(code)
+	})
+}
+
+// ServeFS returns a handler which responds with the file name from fsys, read
+// at request time. It works with embed.FS so fixtures can be compiled into the
+// test binary. A missing or unreadable file responds 500.
+func ServeFS(fsys fs.FS, name string, status int, contentType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		w.Write(b)
+	})
+}
+
+// RawResponse returns a handler which hijacks the connection and writes the
+// response itself, using reason as the status line's reason phrase. The
+// connection is closed afterwards.
+func RawResponse(status int, reason string, headers http.Header, body []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := headers.Clone()
+		if h == nil {
+			h = make(http.Header)
+		}
+		h.Set("Content-Length", fmt.Sprint(len(body)))
+		writeRaw(w, status, reason, h, body)
+	})
+}
+
+// WrongContentLength returns a handler which responds 200 with body but a
+// Content-Length of declared. The connection is hijacked since net/http would
+// otherwise refuse the mismatch.
+func WrongContentLength(declared int64, body []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := http.Header{"Content-Length": {fmt.Sprint(declared)}}
+		writeRaw(w, http.StatusOK, http.StatusText(http.StatusOK), h, body)
+	})
+}
+
+// writeRaw hijacks the connection, writes the response as given and closes
+// the connection.
+func writeRaw(w http.ResponseWriter, status int, reason string, h http.Header, body []byte) {
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(buf, "HTTP/1.1 %03d %s\r\n", status, reason)
+	h.Set("Connection", "close")
+	h.Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	buf.Flush()
+}
+
+// maxRetryAfter caps the Retry-After sent by Backoff429.
+const maxRetryAfter = 24 * time.Hour
+
+// Backoff429 returns a handler which responds to the first threshold calls
+// with 429 Too Many Requests and a Retry-After that doubles on each call:
+// base, 2*base, 4*base and so on, up to a day. Retry-After is in whole
+// seconds, rounded up. Later calls are served by success.
+func Backoff429(base time.Duration, threshold int, success http.Handler) http.Handler {
+	var calls int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&calls, 1) - 1
+		if n >= int64(threshold) {
+			success.ServeHTTP(w, r)
+			return
+		}
+		d := base
+		for i := int64(0); i < n && d < maxRetryAfter; i++ {
+			d *= 2
+		}
+		if d > maxRetryAfter {
+			d = maxRetryAfter
+		}
+		secs := int64((d + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", fmt.Sprint(secs))
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+}
+
+// RoundRobin returns a handler which serves successive calls with each of
+// handlers in turn, wrapping around after the last. Without handlers, calls
+// are served by NotFound.
+func RoundRobin(handlers ...http.Handler) http.Handler {
+	var calls int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(handlers) == 0 {
+			NotFound.ServeHTTP(w, r)
+			return
+		}
+		n := atomic.AddInt64(&calls, 1) - 1
+		handlers[n%int64(len(handlers))].ServeHTTP(w, r)
+	})
+}
+
+// ChecksumTrailer returns a handler which responds with body followed by the
+// trailer headerName set to the hex SHA-256 of what was written.
+func ChecksumTrailer(body []byte, headerName string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", headerName)
+		w.WriteHeader(http.StatusOK)
+
+		h := sha256.New()
+		w.Write(body)
+		h.Write(body)
+		w.Header().Set(headerName, hex.EncodeToString(h.Sum(nil)))
+	})
+}
+
+// RespondStatus returns a handler which responds with code and an empty body.
+func RespondStatus(code int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	})
+}
+
+// AfterN returns a handler which serves the first n calls with before and
+// every call after that with after.
+func AfterN(n int, before, after http.Handler) http.Handler {
+	var calls int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) <= int64(n) {
+			before.ServeHTTP(w, r)
+			return
+		}
+		after.ServeHTTP(w, r)
+	})
+}
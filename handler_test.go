@@ -0,0 +1,308 @@
+package httpassert
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestMirrorHeaders(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: MirrorHeaders("x-trace")})
+
+	req, _ := http.NewRequest("GET", u, nil)
+	req.Header.Set("X-Trace-Id", "abc")
+	req.Header.Set("X-Other", "def")
+	r, err := http.DefaultClient.Do(req)
+	assertResponse(t, 200, r, err)
+
+	if got := r.Header.Get("X-Trace-Id"); got != "abc" {
+		t.Errorf("Expected X-Trace-Id to be (abc), got (%s)", got)
+	}
+	if got := r.Header.Get("X-Other"); got != "" {
+		t.Errorf("Expected X-Other to not be mirrored, got (%s)", got)
+	}
+	s.Assert(t)
+}
+
+func TestStream(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	size := 4 << 20
+	src := bytes.NewReader(make([]byte, size))
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/download", Calls: 1, Handler: Stream(src, "application/octet-stream")})
+
+	r, err := http.Get(u + "/download")
+	assertResponse(t, 200, r, err)
+
+	n, err := io.Copy(io.Discard, r.Body)
+	assertNoError(t, err)
+	if n != int64(size) {
+		t.Errorf("Expected (%d) bytes, got (%d)", size, n)
+	}
+	if r.ContentLength != -1 {
+		t.Errorf("Expected no Content-Length, got (%d)", r.ContentLength)
+	}
+	if got := r.Header.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Expected Content-Type (application/octet-stream), got (%s)", got)
+	}
+	s.Assert(t)
+}
+
+func TestStreamGzip(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	pr, pw := io.Pipe()
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: Stream(pr, "text/plain"), Gzip: true})
+
+	go pw.Write([]byte("hello"))
+	r, err := http.Get(u)
+	assertResponse(t, 200, r, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(r.Body, b)
+	pw.Close()
+	if err != nil || string(b) != "hello" {
+		t.Errorf("Expected streamed body (hello), got (%s) %v", b, err)
+	}
+	io.Copy(io.Discard, r.Body)
+	r.Body.Close()
+	s.Assert(t)
+}
+
+func TestAssertRequest(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	hasName := func(r *http.Request) error {
+		b, _ := readBody(r)
+		if !strings.Contains(string(b), "name") {
+			return errors.New("body is missing name")
+		}
+		return nil
+	}
+	isJSON := func(r *http.Request) error {
+		if r.Header.Get("Content-Type") != "application/json" {
+			return errors.New("not json")
+		}
+		return nil
+	}
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/users", Calls: 2, Handler: AssertRequest(ht, isJSON, hasName)})
+
+	r, err := http.Post(u+"/users", "application/json", strings.NewReader(`{"name": "bob"}`))
+	assertResponse(t, 200, r, err)
+	r, err = http.Post(u+"/users", "application/json", strings.NewReader(`{}`))
+	assertResponse(t, 400, r, err)
+
+	exp := []string{
+		"POST /users failed check: body is missing name",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+	s.Assert(t)
+}
+
+func TestServeFS(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	fsys := fstest.MapFS{
+		"fixtures/user.json": &fstest.MapFile{Data: []byte(`{"id": 1}`)},
+	}
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/user", Calls: 1, Handler: ServeFS(fsys, "fixtures/user.json", 201, "application/json")})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/missing", Calls: 1, Handler: ServeFS(fsys, "fixtures/missing.json", 200, "application/json")})
+
+	r, err := http.Get(u + "/user")
+	assertResponse(t, 201, r, err)
+	b, _ := io.ReadAll(r.Body)
+	if got, exp := string(b), `{"id": 1}`; got != exp {
+		t.Errorf("Expected body (%s), got (%s)", exp, got)
+	}
+	if got := r.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Expected Content-Type (application/json), got (%s)", got)
+	}
+
+	r, err = http.Get(u + "/missing")
+	assertResponse(t, 500, r, err)
+	s.Assert(t)
+}
+
+func TestRawResponse(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: RawResponse(299, "Mostly Fine", http.Header{"X-Custom": {"yes"}}, []byte("body"))})
+
+	r, err := http.Get(u)
+	assertResponse(t, 299, r, err)
+	if got, exp := r.Status, "299 Mostly Fine"; got != exp {
+		t.Errorf("Expected status (%s), got (%s)", exp, got)
+	}
+	if got := r.Header.Get("X-Custom"); got != "yes" {
+		t.Errorf("Expected X-Custom (yes), got (%s)", got)
+	}
+	b, _ := io.ReadAll(r.Body)
+	if string(b) != "body" {
+		t.Errorf("Expected body (body), got (%s)", b)
+	}
+
+	// the client can read the response before the handler returns
+	for i := 0; i < 100 && len(s.Recorded()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	s.Assert(t)
+}
+
+func TestRawResponseForceHTTP10(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.ForceHTTP10 = true
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: RawResponse(299, "Mostly Fine", http.Header{}, []byte("body"))})
+
+	r, err := http.Get(u)
+	assertResponse(t, 299, r, err)
+	b, _ := io.ReadAll(r.Body)
+	if string(b) != "body" {
+		t.Errorf("Expected body (body), got (%s)", b)
+	}
+
+	for i := 0; i < 100 && len(s.Recorded()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	s.Assert(t)
+}
+
+func TestBackoff429(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 5, Handler: Backoff429(time.Second, 3, RespondStatus(200))})
+
+	for _, exp := range []string{"1", "2", "4"} {
+		r, err := http.Get(u)
+		assertResponse(t, 429, r, err)
+		if got := r.Header.Get("Retry-After"); got != exp {
+			t.Errorf("Expected Retry-After (%s), got (%s)", exp, got)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		r, err := http.Get(u)
+		assertResponse(t, 200, r, err)
+		if got := r.Header.Get("Retry-After"); got != "" {
+			t.Errorf("Expected no Retry-After after threshold, got (%s)", got)
+		}
+	}
+	s.Assert(t)
+}
+
+func TestBackoff429Capped(t *testing.T) {
+	h := Backoff429(time.Second, 100, RespondStatus(200))
+	var got string
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		got = w.Header().Get("Retry-After")
+	}
+	if got != "86400" {
+		t.Errorf("Expected Retry-After capped at (86400), got (%s)", got)
+	}
+}
+
+func TestWrongContentLength(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: WrongContentLength(100, []byte("short"))})
+
+	r, err := http.Get(u)
+	assertResponse(t, 200, r, err)
+	if r.ContentLength != 100 {
+		t.Errorf("Expected Content-Length (100), got (%d)", r.ContentLength)
+	}
+	if _, err := io.ReadAll(r.Body); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected (%v), got (%v)", io.ErrUnexpectedEOF, err)
+	}
+
+	for i := 0; i < 100 && len(s.Recorded()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	s.Assert(t)
+}
+
+func TestRoundRobin(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 4, Handler: RoundRobin(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) }),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(202) }),
+	)})
+
+	for _, code := range []int{201, 202, 201, 202} {
+		r, err := http.Get(u)
+		assertResponse(t, code, r, err)
+	}
+	s.Assert(t)
+}
+
+func TestRoundRobinEmpty(t *testing.T) {
+	w := httptest.NewRecorder()
+	RoundRobin().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code of (404), got (%d)", w.Code)
+	}
+}
+
+func TestChecksumTrailer(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	body := []byte("some streamed content")
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: ChecksumTrailer(body, "X-Checksum")})
+
+	r, err := http.Get(u)
+	assertResponse(t, 200, r, err)
+	b, _ := io.ReadAll(r.Body)
+	sum := sha256.Sum256(b)
+	if got, exp := r.Trailer.Get("X-Checksum"), hex.EncodeToString(sum[:]); got != exp {
+		t.Errorf("Expected trailer (%s), got (%s)", exp, got)
+	}
+	if !bytes.Equal(b, body) {
+		t.Errorf("Expected body (%s), got (%s)", body, b)
+	}
+	s.Assert(t)
+}
+
+func TestRespondStatus(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: RespondStatus(503)})
+
+	r, err := http.Get(u)
+	assertResponse(t, 503, r, err)
+	if b, _ := io.ReadAll(r.Body); len(b) != 0 {
+		t.Errorf("Expected empty body, got (%s)", b)
+	}
+
+	if !s.Assert(ht) {
+		t.Errorf("Expected s.Assert to pass, got %v", ht.errors)
+	}
+}
+
+func TestAfterN(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 5, Handler: AfterN(3, RespondStatus(200), RespondStatus(503))})
+
+	for _, code := range []int{200, 200, 200, 503, 503} {
+		r, err := http.Get(u)
+		assertResponse(t, code, r, err)
+	}
+	s.Assert(t)
+}
@@ -0,0 +1,159 @@
+package httpassert
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeadlineHeader is the request header WithDeadlineWithin reads a propagated
+// deadline from, formatted as RFC 3339.
+var DeadlineHeader = "X-Request-Deadline"
+
+// IdempotencyKeyHeader is the request header read by WithIdempotencyKey and
+// Server.AssertIdempotencyKeyReused.
+var IdempotencyKeyHeader = "Idempotency-Key"
+
+// Matcher is an additional check used by ExpectedCall.Match.
+type Matcher func(r *http.Request) bool
+
+// WithContentEncoding matches requests whose Content-Encoding header is enc.
+func WithContentEncoding(enc string) Matcher {
+	return func(r *http.Request) bool {
+		return r.Header.Get("Content-Encoding") == enc
+	}
+}
+
+// WithUpgrade matches requests asking to upgrade to proto, e.g. "websocket".
+func WithUpgrade(proto string) Matcher {
+	return func(r *http.Request) bool {
+		return strings.EqualFold(r.Header.Get("Upgrade"), proto) &&
+			headerHasToken(r.Header, "Connection", "Upgrade")
+	}
+}
+
+// WithoutQueryParam matches requests which don't have the query parameter key.
+func WithoutQueryParam(key string) Matcher {
+	return func(r *http.Request) bool {
+		_, ok := r.URL.Query()[key]
+		return !ok
+	}
+}
+
+// WithQueryPresent matches requests which have the query parameter key, with
+// any value.
+func WithQueryPresent(key string) Matcher {
+	return func(r *http.Request) bool {
+		_, ok := r.URL.Query()[key]
+		return ok
+	}
+}
+
+// WithDeadlineWithin matches requests whose deadline is no more than d away.
+//
+// A client's context deadline isn't sent over the wire, so the server's
+// r.Context() only carries a deadline if something on the server set one. When
+// it doesn't, the deadline is read from DeadlineHeader, which the client must
+// propagate itself. Requests without a deadline don't match.
+func WithDeadlineWithin(d time.Duration) Matcher {
+	return func(r *http.Request) bool {
+		deadline, ok := r.Context().Deadline()
+		if !ok {
+			var err error
+			deadline, err = time.Parse(time.RFC3339Nano, r.Header.Get(DeadlineHeader))
+			if err != nil {
+				return false
+			}
+		}
+		return time.Until(deadline) <= d
+	}
+}
+
+// EmptyJSONObject matches requests whose body is the JSON object {}.
+func EmptyJSONObject() Matcher {
+	return func(r *http.Request) bool {
+		var v map[string]json.RawMessage
+		return decodeBody(r, &v) && v != nil && len(v) == 0
+	}
+}
+
+// EmptyJSONArray matches requests whose body is the JSON array [].
+func EmptyJSONArray() Matcher {
+	return func(r *http.Request) bool {
+		var v []json.RawMessage
+		return decodeBody(r, &v) && v != nil && len(v) == 0
+	}
+}
+
+// WithUploadSize matches multipart requests with a file in the form field
+// whose size is between min and max bytes inclusive.
+func WithUploadSize(field string, min, max int64) Matcher {
+	return func(r *http.Request) bool {
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || params["boundary"] == "" {
+			return false
+		}
+		b, err := readBody(r)
+		if err != nil {
+			return false
+		}
+		mr := multipart.NewReader(bytes.NewReader(b), params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				return false
+			}
+			if p.FormName() != field || p.FileName() == "" {
+				continue
+			}
+			n, err := io.Copy(io.Discard, p)
+			return err == nil && min <= n && n <= max
+		}
+	}
+}
+
+// decodeBody decodes the JSON body of r into v, restoring the body.
+func decodeBody(r *http.Request, v interface{}) bool {
+	b, err := readBody(r)
+	return err == nil && json.Unmarshal(b, v) == nil
+}
+
+// headerHasToken reports whether the comma separated header key contains
+// token, compared case insensitively.
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithResumedTLS matches TLS requests whose connection did, or did not,
+// resume a previous session. Plain HTTP requests never match.
+func WithResumedTLS(resumed bool) Matcher {
+	return func(r *http.Request) bool {
+		return r.TLS != nil && r.TLS.DidResume == resumed
+	}
+}
+
+// WithIdempotencyKey matches requests carrying key in IdempotencyKeyHeader.
+func WithIdempotencyKey(key string) Matcher {
+	return func(r *http.Request) bool {
+		return r.Header.Get(IdempotencyKeyHeader) == key
+	}
+}
+
+// WithReferer matches requests whose Referer header is ref.
+func WithReferer(ref string) Matcher {
+	return func(r *http.Request) bool {
+		return r.Referer() == ref
+	}
+}
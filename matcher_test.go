@@ -0,0 +1,270 @@
+package httpassert
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithContentEncoding(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/upload", Calls: 1, Handler: h,
+		Matchers: []Matcher{WithContentEncoding("gzip")},
+	})
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("hello"))
+	zw.Close()
+
+	req, _ := http.NewRequest("POST", u+"/upload", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	r, err := http.DefaultClient.Do(req)
+	assertResponse(t, 200, r, err)
+
+	r, err = http.Post(u+"/upload", "text/plain", bytes.NewBufferString("hello"))
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		`Server(testserver) got (1) unexpected calls to POST /upload, first with body "hello"`,
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestWithUpgrade(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/ws", Calls: 1, Handler: h,
+		Matchers: []Matcher{WithUpgrade("websocket")},
+	})
+
+	req, _ := http.NewRequest("GET", u+"/ws", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	r, err := http.DefaultClient.Do(req)
+	assertResponse(t, 200, r, err)
+
+	r, err = http.Get(u + "/ws")
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to GET /ws",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestWithoutQueryParam(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/track", Calls: 1, Handler: h,
+		Matchers: []Matcher{WithoutQueryParam("internal_id")},
+	})
+
+	r, err := http.Get(u + "/track?page=1")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/track?page=1&internal_id=")
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to GET /track",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestWithQueryPresent(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/app.js", Calls: 2, Handler: h,
+		Matchers: []Matcher{WithQueryPresent("t")},
+	})
+
+	r, err := http.Get(u + "/app.js?t=1700000000")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/app.js?v=2&t=")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/app.js?v=2")
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to GET /app.js",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestWithDeadlineWithin(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: h,
+		Matchers: []Matcher{WithDeadlineWithin(time.Second)},
+	})
+
+	get := func(d time.Duration) (*http.Response, error) {
+		req, _ := http.NewRequest("GET", u, nil)
+		req.Header.Set(DeadlineHeader, time.Now().Add(d).Format(time.RFC3339Nano))
+		return http.DefaultClient.Do(req)
+	}
+	r, err := get(500 * time.Millisecond)
+	assertResponse(t, 200, r, err)
+	r, err = get(time.Minute)
+	assertResponse(t, 404, r, err)
+	r, err = http.Get(u)
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (2) unexpected calls to GET /",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestEmptyJSON(t *testing.T) {
+	for _, tc := range []struct {
+		body        string
+		object, arr bool
+	}{
+		{`{}`, true, false},
+		{` [ ] `, false, true},
+		{`{"a":1}`, false, false},
+		{`[1]`, false, false},
+		{``, false, false},
+		{`null`, false, false},
+	} {
+		r, _ := http.NewRequest("POST", "/", strings.NewReader(tc.body))
+		if got := EmptyJSONObject()(r); got != tc.object {
+			t.Errorf("Expected EmptyJSONObject(%q) to be (%t), got (%t)", tc.body, tc.object, got)
+		}
+		if got := EmptyJSONArray()(r); got != tc.arr {
+			t.Errorf("Expected EmptyJSONArray(%q) to be (%t), got (%t)", tc.body, tc.arr, got)
+		}
+	}
+}
+
+func TestWithUploadSize(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	var name string
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/upload", Calls: 1,
+		Matchers: []Matcher{WithUploadSize("file", 10, 100)},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, fh, err := r.FormFile("file"); err == nil {
+				name = fh.Filename
+			}
+		}),
+	})
+
+	upload := func(size int) (*http.Response, error) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.SetBoundary("boundary")
+		mw.WriteField("title", "report")
+		fw, _ := mw.CreateFormFile("file", "report.txt")
+		fw.Write(bytes.Repeat([]byte("a"), size))
+		mw.Close()
+		return http.Post(u+"/upload", mw.FormDataContentType(), &buf)
+	}
+	r, err := upload(50)
+	assertResponse(t, 200, r, err)
+	if name != "report.txt" {
+		t.Errorf("Expected handler to read the file, got (%s)", name)
+	}
+	r, err = upload(500)
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		`Server(testserver) got (1) unexpected calls to POST /upload, first with body "--boundary\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nrepo"...`,
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestWithResumedTLS(t *testing.T) {
+	ht := new(helperT)
+	s := New("testserver", nil)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/first", Calls: 1, Handler: h,
+		Matchers: []Matcher{WithResumedTLS(false)},
+	})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/second", Calls: 1, Handler: h,
+		Matchers: []Matcher{WithResumedTLS(true)},
+	})
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	c := ts.Client()
+	tr := c.Transport.(*http.Transport)
+	tr.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	tr.DisableKeepAlives = true
+
+	r, err := c.Get(ts.URL + "/first")
+	assertResponse(t, 200, r, err)
+	r, err = c.Get(ts.URL + "/second")
+	assertResponse(t, 200, r, err)
+
+	if !s.Assert(ht) {
+		t.Errorf("Expected s.Assert to pass, got %v", ht.errors)
+	}
+}
+
+func TestWithReferer(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/next", Calls: 1, Handler: RespondStatus(200),
+		Matchers: []Matcher{WithReferer("https://example.com/start")},
+	})
+
+	for ref, code := range map[string]int{
+		"https://example.com/start": 200,
+		"https://example.com/other": 404,
+		"":                          404,
+	} {
+		req, _ := http.NewRequest("GET", u+"/next", nil)
+		if ref != "" {
+			req.Header.Set("Referer", ref)
+		}
+		r, err := http.DefaultClient.Do(req)
+		assertResponse(t, code, r, err)
+	}
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (2) unexpected calls to GET /next",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
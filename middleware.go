@@ -0,0 +1,82 @@
+package httpassert
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// VerifyContentMD5 returns middleware which responds 400 to requests whose
+// Content-MD5 header doesn't match the base64 MD5 of the body. Requests
+// without the header are passed through.
+func VerifyContentMD5() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want := r.Header.Get("Content-MD5")
+			if want == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			b, err := readBody(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sum := md5.Sum(b)
+			if got := base64.StdEncoding.EncodeToString(sum[:]); got != want {
+				http.Error(w, "Content-MD5 mismatch", http.StatusBadRequest)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// StatusEndpoint returns middleware which responds to requests for path with a
+// JSON snapshot of the server's expectations and their remaining calls. These
+// requests are never matched or recorded, so the mock can be inspected with
+// curl during a test.
+func StatusEndpoint(path string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s := serverFromContext(r.Context())
+			if r.URL.Path != path || s == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s.status())
+		})
+	}
+}
+
+type serverStatus struct {
+	Name         string              `json:"name"`
+	Expectations []expectationStatus `json:"expectations"`
+}
+
+type expectationStatus struct {
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Remaining  int    `json:"remaining"`
+	AnyTimes   bool   `json:"anyTimes,omitempty"`
+	Unexpected bool   `json:"unexpected,omitempty"`
+}
+
+func (s *Server) status() serverStatus {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	st := serverStatus{Name: s.Name, Expectations: []expectationStatus{}}
+	for _, ec := range s.ExpectedCalls {
+		st.Expectations = append(st.Expectations, expectationStatus{
+			Method:     ec.Method,
+			Path:       ec.Path,
+			Remaining:  ec.remaining(),
+			AnyTimes:   ec.AnyTimes,
+			Unexpected: ec.unexpected,
+		})
+	}
+	return st
+}
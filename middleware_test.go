@@ -0,0 +1,61 @@
+package httpassert
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVerifyContentMD5(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Use(VerifyContentMD5())
+	var body string
+	s.Expect(&ExpectedCall{Method: "PUT", Path: "/object", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := readBody(r)
+		body = string(b)
+	})})
+
+	put := func(md5 string) (*http.Response, error) {
+		req, _ := http.NewRequest("PUT", u+"/object", strings.NewReader("hello"))
+		req.Header.Set("Content-MD5", md5)
+		return http.DefaultClient.Do(req)
+	}
+
+	r, err := put("XUFAKrxLKna5cZ2REBfFkg==")
+	assertResponse(t, 200, r, err)
+	if body != "hello" {
+		t.Errorf("Expected handler to read body (hello), got (%s)", body)
+	}
+
+	r, err = put("AAAAAAAAAAAAAAAAAAAAAA==")
+	assertResponse(t, 400, r, err)
+
+	s.Assert(t)
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Use(StatusEndpoint("/__httpassert"))
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/users", Calls: 2, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+
+	r, err := http.Get(u + "/users")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/__httpassert")
+	assertResponse(t, 200, r, err)
+
+	var got serverStatus
+	assertNoError(t, json.NewDecoder(r.Body).Decode(&got))
+	exp := serverStatus{Name: "testserver", Expectations: []expectationStatus{
+		{Method: "GET", Path: "/users", Remaining: 1},
+	}}
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("Expected status (%+v), got (%+v)", exp, got)
+	}
+	if n := len(s.Recorded()); n != 1 {
+		t.Errorf("Expected status request to not be recorded, got (%d) calls", n)
+	}
+}
@@ -0,0 +1,68 @@
+package httpassert
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ServeMux is an http.ServeMux which remembers the patterns registered with
+// it, so FromServeMux can build expectations for them.
+type ServeMux struct {
+	*http.ServeMux
+
+	patterns []string
+}
+
+// Mux returns a new ServeMux.
+func Mux() *ServeMux {
+	return &ServeMux{ServeMux: http.NewServeMux()}
+}
+
+// Handle registers h for pattern, see http.ServeMux.Handle.
+func (m *ServeMux) Handle(pattern string, h http.Handler) {
+	m.ServeMux.Handle(pattern, h)
+	m.patterns = append(m.patterns, pattern)
+}
+
+// HandleFunc registers h for pattern, see http.ServeMux.HandleFunc.
+func (m *ServeMux) HandleFunc(pattern string, h func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(h))
+}
+
+// FromServeMux returns an expectation for each pattern registered with mux,
+// in registration order. Each matches the requests mux routes to its pattern,
+// is served by mux and may be called any number of times, so calls can be
+// counted without constraining them.
+func FromServeMux(mux *ServeMux) []*ExpectedCall {
+	var ecs []*ExpectedCall
+	for _, pattern := range mux.patterns {
+		pattern := pattern
+		method, path := splitPattern(pattern)
+		ecs = append(ecs, &ExpectedCall{
+			Method:   method,
+			Path:     path,
+			Handler:  mux.ServeMux,
+			AnyTimes: true,
+			MatchFunc: func(r *http.Request) bool {
+				_, p := mux.ServeMux.Handler(r)
+				return p == pattern
+			},
+		})
+	}
+	return ecs
+}
+
+// splitPattern returns the method and the literal path prefix of a ServeMux
+// pattern such as "GET example.com/users/{id}".
+func splitPattern(pattern string) (method, path string) {
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		method, pattern = pattern[:i], strings.TrimLeft(pattern[i:], " \t")
+	}
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		pattern = pattern[i:]
+	}
+	if i := strings.Index(pattern, "{"); i >= 0 {
+		pattern = pattern[:i]
+	}
+	return method, pattern
+}
@@ -0,0 +1,56 @@
+package httpassert
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFromServeMux(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	mux := Mux()
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	ecs := FromServeMux(mux)
+	if len(ecs) != 2 {
+		t.Fatalf("Expected (2) expectations, got (%d)", len(ecs))
+	}
+	if ecs[0].Path != "/users/" || ecs[1].Path != "/health" {
+		t.Errorf("Expected /users/ and /health, got %s and %s", ecs[0].Path, ecs[1].Path)
+	}
+	for _, ec := range ecs {
+		s.Expect(ec)
+	}
+
+	r, err := http.Get(u + "/users/42")
+	assertResponse(t, 200, r, err)
+	r, err = http.Post(u+"/health", "", nil)
+	assertResponse(t, 204, r, err)
+	r, err = http.Get(u + "/health")
+	assertResponse(t, 204, r, err)
+
+	if n := ecs[0].remaining(); n != -1 {
+		t.Errorf("Expected (1) call to /users/, got (%d)", -n)
+	}
+	if n := ecs[1].remaining(); n != -2 {
+		t.Errorf("Expected (2) calls to /health, got (%d)", -n)
+	}
+	s.Assert(t)
+}
+
+func TestSplitPattern(t *testing.T) {
+	for _, tc := range []struct{ pattern, method, path string }{
+		{"/users/", "", "/users/"},
+		{"GET /users/{id}", "GET", "/users/"},
+		{"POST  example.com/items/{id}/tags", "POST", "/items/"},
+		{"example.com/", "", "/"},
+	} {
+		method, path := splitPattern(tc.pattern)
+		if method != tc.method || path != tc.path {
+			t.Errorf("Expected splitPattern(%q) to be (%s, %s), got (%s, %s)", tc.pattern, tc.method, tc.path, method, path)
+		}
+	}
+}
@@ -0,0 +1,723 @@
+package httpassert
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RecordedCall is a request received by a Server.
+type RecordedCall struct {
+	Method string
+	Path   string
+
+	// Request is a copy of the received request. Its Body has been consumed;
+	// use Body instead.
+	Request *http.Request
+	Body    []byte
+
+	// Time is when the request arrived and Duration how long it took to
+	// serve, according to Server.Now.
+	Time     time.Time
+	Duration time.Duration
+
+	// StatusCode, ResponseHeader and ResponseBody are what the server
+	// responded with. StatusCode is zero if the client went away before
+	// anything was written.
+	StatusCode     int
+	ResponseHeader http.Header
+	ResponseBody   []byte
+
+	// Expectation is the ExpectedCall which served the request.
+	Expectation *ExpectedCall
+
+	// Fingerprint is the result of Server.Fingerprint, if set.
+	Fingerprint string
+
+	// RawHeaders are the request's header lines in the order they were
+	// received, e.g. "Content-Type: text/plain". They aren't captured for
+	// Servers created with NewTLS.
+	RawHeaders []string
+}
+
+// request returns a copy of the recorded request with a readable Body.
+func (rc *RecordedCall) request() *http.Request {
+	r := rc.Request.Clone(rc.Request.Context())
+	r.Body = io.NopCloser(bytes.NewReader(rc.Body))
+	return r
+}
+
+// bodyRecorder keeps a copy of the bytes read through it.
+type bodyRecorder struct {
+	io.ReadCloser
+	buf bytes.Buffer
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+// responseRecorder keeps a copy of the response written through it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// encoded is set when a writer above compresses the response, it records
+	// the uncompressed body itself.
+	encoded bool
+}
+
+func (rw *responseRecorder) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if !rw.encoded {
+		rw.body.Write(b)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (rw *responseRecorder) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker
+func (rw *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("httpassert: ResponseWriter does not implement http.Hijacker")
+	}
+	return h.Hijack()
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+type recorderKey struct{}
+
+// recorderFromContext returns the responseRecorder for the request with ctx.
+func recorderFromContext(ctx context.Context) *responseRecorder {
+	rw, _ := ctx.Value(recorderKey{}).(*responseRecorder)
+	return rw
+}
+
+// rawListener wraps its connections in rawConns, so the order of request
+// headers can be recovered.
+type rawListener struct {
+	net.Listener
+}
+
+func (l *rawListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rawConn{Conn: c}, nil
+}
+
+// rawConn keeps the bytes read from it from the start of a request up to
+// the end of its headers. It stops there, so request bodies aren't kept,
+// until resume is called once the request has been served.
+type rawConn struct {
+	net.Conn
+
+	buf  []byte
+	done bool
+	m    sync.Mutex
+}
+
+func (c *rawConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if !c.done {
+		c.buf = append(c.buf, p[:n]...)
+		if i := bytes.Index(c.buf, []byte("\r\n\r\n")); i >= 0 {
+			c.buf, c.done = c.buf[:i+4], true
+		}
+	}
+	return n, err
+}
+
+// headers returns the header lines of r if the captured bytes start with its
+// request line.
+func (c *rawConn) headers(r *http.Request) []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	line := []byte(r.Method + " " + r.RequestURI + " " + r.Proto + "\r\n")
+	if !c.done || !bytes.HasPrefix(c.buf, line) {
+		return nil
+	}
+	block := c.buf[len(line) : len(c.buf)-4]
+	if len(block) == 0 {
+		return nil
+	}
+	return strings.Split(string(block), "\r\n")
+}
+
+// resume starts capturing the next request.
+func (c *rawConn) resume() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.buf, c.done = nil, false
+}
+
+type rawConnKey struct{}
+
+// rawConnContext makes a rawConn available to the requests read from it.
+func rawConnContext(ctx context.Context, c net.Conn) context.Context {
+	if rc, ok := c.(*rawConn); ok {
+		return context.WithValue(ctx, rawConnKey{}, rc)
+	}
+	return ctx
+}
+
+// rawHeaders returns the header lines of r in the order they were received,
+// or nil if they weren't captured.
+func rawHeaders(r *http.Request) []string {
+	if rc, ok := r.Context().Value(rawConnKey{}).(*rawConn); ok {
+		return rc.headers(r)
+	}
+	return nil
+}
+
+// resumeRawHeaders starts capturing the headers of the next request on r's
+// connection. It must only be called once r's body has been consumed.
+func resumeRawHeaders(r *http.Request) {
+	if rc, ok := r.Context().Value(rawConnKey{}).(*rawConn); ok {
+		rc.resume()
+	}
+}
+
+// AssertHeaderBefore checks that header a was received before header b in
+// the recorded call rc. Header names are case insensitive.
+func AssertHeaderBefore(t testing.TB, rc *RecordedCall, a, b string) bool {
+	t.Helper()
+
+	ia, ib := -1, -1
+	for i, line := range rc.RawHeaders {
+		name, _, _ := strings.Cut(line, ":")
+		if ia < 0 && strings.EqualFold(name, a) {
+			ia = i
+		}
+		if ib < 0 && strings.EqualFold(name, b) {
+			ib = i
+		}
+	}
+	if ia < 0 || ib < 0 {
+		t.Errorf("%s %s expected headers %s and %s, got %q", rc.Method, rc.Path, a, b, rc.RawHeaders)
+		return false
+	}
+	if ia > ib {
+		t.Errorf("%s %s expected header %s before %s, got %q", rc.Method, rc.Path, a, b, rc.RawHeaders)
+		return false
+	}
+	return true
+}
+
+// readBody reads the whole of r.Body and replaces it so it can be read again.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	b, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	return b, err
+}
+
+// record drains whatever the handler left unread and adds the request to the
+// recorded calls.
+func (s *Server) record(rw *responseRecorder, r *http.Request, raw []string, body *bodyRecorder, start time.Time, ec *ExpectedCall) {
+	io.Copy(io.Discard, body)
+
+	// Nothing written yet means an implicit 200 follows, unless the client
+	// has already gone away.
+	status := rw.status
+	if status == 0 && r.Context().Err() == nil {
+		status = http.StatusOK
+	}
+	rc := &RecordedCall{
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		Request:        r.Clone(r.Context()),
+		Body:           body.buf.Bytes(),
+		Time:           start,
+		Duration:       s.now().Sub(start),
+		StatusCode:     status,
+		ResponseHeader: rw.Header().Clone(),
+		ResponseBody:   rw.body.Bytes(),
+		Expectation:    ec,
+		RawHeaders:     raw,
+	}
+	if s.Fingerprint != nil {
+		rc.Fingerprint = s.Fingerprint(r)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.calls = append(s.calls, rc)
+	// Trimming only once twice the limit is reached keeps recording O(1)
+	// amortized, Recorded hides the extra calls.
+	if max := s.MaxRecordedCalls; max > 0 && len(s.calls) >= 2*max {
+		n := copy(s.calls, s.calls[len(s.calls)-max:])
+		for i := n; i < len(s.calls); i++ {
+			s.calls[i] = nil
+		}
+		s.calls = s.calls[:n]
+	}
+	s.bytesReceived += int64(len(rc.Body))
+	s.bytesSent += int64(len(rc.ResponseBody))
+}
+
+// Recorded returns the calls received by the server, in the order they
+// completed. If Server.MaxRecordedCalls is set only the most recent calls are
+// kept.
+func (s *Server) Recorded() []*RecordedCall {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	calls := s.calls
+	if max := s.MaxRecordedCalls; max > 0 && len(calls) > max {
+		calls = calls[len(calls)-max:]
+	}
+	return append([]*RecordedCall(nil), calls...)
+}
+
+// Received returns a copy of each recorded request, with a Body which can be
+// read again, in the order they completed.
+func (s *Server) Received() []*http.Request {
+	var reqs []*http.Request
+	for _, rc := range s.Recorded() {
+		reqs = append(reqs, rc.request())
+	}
+	return reqs
+}
+
+// Requests returns a copy of each recorded request served by ec, with a Body
+// which can be read again.
+func (ec *ExpectedCall) Requests() []*http.Request {
+	if ec.server == nil {
+		return nil
+	}
+	var reqs []*http.Request
+	for _, rc := range ec.server.Recorded() {
+		if rc.Expectation == ec {
+			reqs = append(reqs, rc.request())
+		}
+	}
+	return reqs
+}
+
+// Dump writes every recorded request, with its headers and body, to w. It is
+// meant for debugging, e.g. from a cleanup function of a failing test.
+func (s *Server) Dump(w io.Writer) {
+	for i, rc := range s.Recorded() {
+		fmt.Fprintf(w, "Server(%s) call (%d):\n", s.Name, i)
+		b, err := httputil.DumpRequest(rc.request(), true)
+		if err != nil {
+			fmt.Fprintf(w, "%s\n\n", err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\n\n", b)
+	}
+}
+
+// BytesReceived returns the total number of request body bytes received.
+func (s *Server) BytesReceived() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.bytesReceived
+}
+
+// AssertBytesReceived checks that exactly n request body bytes were received.
+func (s *Server) AssertBytesReceived(t testing.TB, n int64) bool {
+	t.Helper()
+
+	if got := s.BytesReceived(); got != n {
+		t.Errorf("Server(%s) expected (%d) bytes received, got (%d)", s.Name, n, got)
+		return false
+	}
+	return true
+}
+
+// BytesSent returns the total number of response body bytes written.
+func (s *Server) BytesSent() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.bytesSent
+}
+
+// AssertBytesSent checks that exactly n response body bytes were written.
+func (s *Server) AssertBytesSent(t testing.TB, n int64) bool {
+	t.Helper()
+
+	if got := s.BytesSent(); got != n {
+		t.Errorf("Server(%s) expected (%d) bytes sent, got (%d)", s.Name, n, got)
+		return false
+	}
+	return true
+}
+
+// CallLog is a list of recorded calls with helper queries.
+type CallLog []*RecordedCall
+
+// Log returns the calls received by the server as a CallLog.
+func (s *Server) Log() CallLog {
+	return CallLog(s.Recorded())
+}
+
+// Count returns the number of calls to method and path.
+func (l CallLog) Count(method, path string) int {
+	return len(l.Filter(matchCall(method, path)))
+}
+
+// First returns the first call to method and path, or nil if there was none.
+func (l CallLog) First(method, path string) *RecordedCall {
+	if calls := l.Filter(matchCall(method, path)); len(calls) > 0 {
+		return calls[0]
+	}
+	return nil
+}
+
+// Filter returns the calls for which keep returns true.
+func (l CallLog) Filter(keep func(*RecordedCall) bool) []*RecordedCall {
+	var calls []*RecordedCall
+	for _, rc := range l {
+		if keep(rc) {
+			calls = append(calls, rc)
+		}
+	}
+	return calls
+}
+
+func matchCall(method, path string) func(*RecordedCall) bool {
+	return func(rc *RecordedCall) bool {
+		return rc.Method == method && rc.Path == path
+	}
+}
+
+// MaxHandlerDuration returns the longest time taken to serve a call.
+func (s *Server) MaxHandlerDuration() time.Duration {
+	var max time.Duration
+	for _, rc := range s.Recorded() {
+		if rc.Duration > max {
+			max = rc.Duration
+		}
+	}
+	return max
+}
+
+// AssertHandlerUnder checks that every call was served in less than d.
+func (s *Server) AssertHandlerUnder(t testing.TB, d time.Duration) bool {
+	t.Helper()
+
+	if max := s.MaxHandlerDuration(); max >= d {
+		t.Errorf("Server(%s) expected calls to be served in under %s, slowest took %s", s.Name, d, max)
+		return false
+	}
+	return true
+}
+
+// MeanHandlerDuration returns the average time taken to serve a call, or zero
+// if there were none.
+func (s *Server) MeanHandlerDuration() time.Duration {
+	calls := s.Recorded()
+	if len(calls) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, rc := range calls {
+		total += rc.Duration
+	}
+	return total / time.Duration(len(calls))
+}
+
+// AssertMeanUnder checks that calls were served in less than d on average.
+func (s *Server) AssertMeanUnder(t testing.TB, d time.Duration) bool {
+	t.Helper()
+
+	if mean := s.MeanHandlerDuration(); mean >= d {
+		t.Errorf("Server(%s) expected calls to be served in under %s on average, took %s", s.Name, d, mean)
+		return false
+	}
+	return true
+}
+
+// CountByFingerprint returns the number of recorded calls with fingerprint fp.
+func (s *Server) CountByFingerprint(fp string) int {
+	return len(s.Log().Filter(func(rc *RecordedCall) bool {
+		return rc.Fingerprint == fp
+	}))
+}
+
+// StatusCounts returns the number of recorded calls served with each status
+// code. Calls the client abandoned before a response was written aren't
+// counted.
+func (s *Server) StatusCounts() map[int]int {
+	counts := map[int]int{}
+	for _, rc := range s.Recorded() {
+		if rc.StatusCode != 0 {
+			counts[rc.StatusCode]++
+		}
+	}
+	return counts
+}
+
+// AssertStatusCount checks that exactly n calls were served with status code.
+func (s *Server) AssertStatusCount(t testing.TB, code, n int) bool {
+	t.Helper()
+
+	if got := s.StatusCounts()[code]; got != n {
+		t.Errorf("Server(%s) expected (%d) responses with status (%d), got (%d)", s.Name, n, code, got)
+		return false
+	}
+	return true
+}
+
+// AssertIdempotencyKeyReused checks that at least two recorded calls carried
+// the same IdempotencyKeyHeader, i.e. that the client retried a request.
+func (s *Server) AssertIdempotencyKeyReused(t testing.TB) bool {
+	t.Helper()
+
+	seen := make(map[string]bool)
+	for _, rc := range s.Recorded() {
+		key := rc.Request.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			continue
+		}
+		if seen[key] {
+			return true
+		}
+		seen[key] = true
+	}
+	t.Errorf("Server(%s) expected a request to reuse an %s, got (%d) distinct keys", s.Name, IdempotencyKeyHeader, len(seen))
+	return false
+}
+
+// recorded returns the recorded call at index, reporting an error if there is
+// none.
+func (s *Server) recorded(t testing.TB, index int) (*RecordedCall, bool) {
+	t.Helper()
+
+	calls := s.Recorded()
+	if index < 0 || index >= len(calls) {
+		t.Errorf("Server(%s) has no recorded call (%d), got (%d) calls", s.Name, index, len(calls))
+		return nil, false
+	}
+	return calls[index], true
+}
+
+// AssertBodyField checks that the JSON body of the recorded call at index has
+// want at jsonPath. jsonPath is a dot separated list of object keys and array
+// indexes, e.g. "users.0.id". want is compared after a round trip through
+// encoding/json, so 42 equals the decoded float64 42.
+func (s *Server) AssertBodyField(t testing.TB, index int, jsonPath string, want interface{}) bool {
+	t.Helper()
+
+	rc, ok := s.recorded(t, index)
+	if !ok {
+		return false
+	}
+
+	var got interface{}
+	if err := json.Unmarshal(rc.Body, &got); err != nil {
+		t.Errorf("Server(%s) call (%d) body is not JSON: %v", s.Name, index, err)
+		return false
+	}
+	got, err := jsonField(got, jsonPath)
+	if err != nil {
+		t.Errorf("Server(%s) call (%d) body %v", s.Name, index, err)
+		return false
+	}
+
+	exp, err := normalizeJSON(want)
+	if err != nil {
+		t.Errorf("Server(%s) cannot encode want: %v", s.Name, err)
+		return false
+	}
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("Server(%s) call (%d) expected %s to be (%v), got (%v)", s.Name, index, jsonPath, exp, got)
+		return false
+	}
+	return true
+}
+
+// AssertJSONResponse checks that the JSON response body of the recorded call
+// at index is semantically equal to want.
+func (s *Server) AssertJSONResponse(t testing.TB, index int, want interface{}) bool {
+	t.Helper()
+
+	rc, ok := s.recorded(t, index)
+	if !ok {
+		return false
+	}
+
+	var got interface{}
+	if err := json.Unmarshal(rc.ResponseBody, &got); err != nil {
+		t.Errorf("Server(%s) call (%d) response is not JSON: %v", s.Name, index, err)
+		return false
+	}
+	exp, err := normalizeJSON(want)
+	if err != nil {
+		t.Errorf("Server(%s) cannot encode want: %v", s.Name, err)
+		return false
+	}
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("Server(%s) call (%d) expected response (%v), got (%v)", s.Name, index, exp, got)
+		return false
+	}
+	return true
+}
+
+// AssertEveryRequest runs check against each recorded request, reporting the
+// index of any which fail.
+func (s *Server) AssertEveryRequest(t testing.TB, check func(*http.Request) error) bool {
+	t.Helper()
+	pass := true
+
+	for i, rc := range s.Recorded() {
+		if err := check(rc.request()); err != nil {
+			t.Errorf("Server(%s) call (%d) %s %s failed check: %v", s.Name, i, rc.Method, rc.Path, err)
+			pass = false
+		}
+	}
+	return pass
+}
+
+// AssertResponsesValidJSON checks that every recorded response with a JSON
+// Content-Type has a valid JSON body.
+func (s *Server) AssertResponsesValidJSON(t testing.TB) bool {
+	t.Helper()
+	pass := true
+
+	for i, rc := range s.Recorded() {
+		if !isJSON(rc.ResponseHeader.Get("Content-Type")) {
+			continue
+		}
+		if !json.Valid(rc.ResponseBody) {
+			t.Errorf("Server(%s) call (%d) %s %s responded with invalid JSON: %q", s.Name, i, rc.Method, rc.Path, rc.ResponseBody)
+			pass = false
+		}
+	}
+	return pass
+}
+
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
+}
+
+// AssertQueryParam checks that the recorded call at index has the query
+// parameter key set to want.
+func (s *Server) AssertQueryParam(t testing.TB, index int, key, want string) bool {
+	t.Helper()
+
+	rc, ok := s.recorded(t, index)
+	if !ok {
+		return false
+	}
+
+	q := rc.Request.URL.Query()
+	if _, ok := q[key]; !ok {
+		t.Errorf("Server(%s) call (%d) expected query param %s to be (%s), but it is missing", s.Name, index, key, want)
+		return false
+	}
+	if got := q.Get(key); got != want {
+		t.Errorf("Server(%s) call (%d) expected query param %s to be (%s), got (%s)", s.Name, index, key, want, got)
+		return false
+	}
+	return true
+}
+
+// normalizeJSON round trips v through encoding/json so it can be compared with
+// decoded values.
+func normalizeJSON(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var n interface{}
+	err = json.Unmarshal(b, &n)
+	return n, err
+}
+
+// AssertMinTLS checks that the recorded call at index was made over TLS of at
+// least version, e.g. tls.VersionTLS12.
+func (s *Server) AssertMinTLS(t testing.TB, index int, version uint16) bool {
+	t.Helper()
+
+	rc, ok := s.recorded(t, index)
+	if !ok {
+		return false
+	}
+	if rc.Request.TLS == nil {
+		t.Errorf("Server(%s) call (%d) expected TLS of at least %s, got none", s.Name, index, tls.VersionName(version))
+		return false
+	}
+	if got := rc.Request.TLS.Version; got < version {
+		t.Errorf("Server(%s) call (%d) expected TLS of at least %s, got %s", s.Name, index, tls.VersionName(version), tls.VersionName(got))
+		return false
+	}
+	return true
+}
+
+// jsonField walks v, as decoded by encoding/json, along path.
+func jsonField(v interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return v, nil
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = x[key]; !ok {
+				return nil, fmt.Errorf("has no field %s in %s", key, path)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, fmt.Errorf("has no index %s in %s", key, path)
+			}
+			v = x[i]
+		default:
+			return nil, fmt.Errorf("cannot index %s in %s", key, path)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,757 @@
+package httpassert
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBytesReceived(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/upload", Calls: 2, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+
+	r, err := http.Post(u+"/upload", "text/plain", strings.NewReader("hello"))
+	assertResponse(t, 200, r, err)
+	r, err = http.Post(u+"/upload", "text/plain", strings.NewReader("world!"))
+	assertResponse(t, 200, r, err)
+
+	if !s.AssertBytesReceived(ht, 11) {
+		t.Errorf("Expected s.AssertBytesReceived to pass")
+	}
+	if s.AssertBytesReceived(ht, 5) {
+		t.Errorf("Expected s.AssertBytesReceived to not pass")
+	}
+	exp := []string{
+		"Server(testserver) expected (5) bytes received, got (11)",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestBytesSent(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.On("GET", "/a").Respond(200, "hello")
+	s.On("GET", "/b").Respond(200, "world!")
+
+	r, err := http.Get(u + "/a")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/b")
+	assertResponse(t, 200, r, err)
+
+	if !s.AssertBytesSent(ht, 11) {
+		t.Errorf("Expected s.AssertBytesSent to pass")
+	}
+	if s.AssertBytesSent(ht, 5) {
+		t.Errorf("Expected s.AssertBytesSent to not pass")
+	}
+	exp := []string{
+		"Server(testserver) expected (5) bytes sent, got (11)",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestCatchAll(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.CatchAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r, err := http.Get(u + "/a")
+	assertResponse(t, 200, r, err)
+	r, err = http.Post(u+"/b/c", "text/plain", strings.NewReader("hello"))
+	assertResponse(t, 200, r, err)
+
+	if !s.Assert(ht) {
+		t.Errorf("Expected s.Assert to pass")
+	}
+	assertExpectedCalls(t, nil, ht.errors)
+
+	calls := s.Recorded()
+	if len(calls) != 2 {
+		t.Fatalf("Expected (2) recorded calls, got (%d)", len(calls))
+	}
+	if calls[0].Method != "GET" || calls[0].Path != "/a" {
+		t.Errorf("Expected GET /a, got %s %s", calls[0].Method, calls[0].Path)
+	}
+	if calls[1].Method != "POST" || calls[1].Path != "/b/c" || string(calls[1].Body) != "hello" {
+		t.Errorf("Expected POST /b/c hello, got %s %s %s", calls[1].Method, calls[1].Path, calls[1].Body)
+	}
+}
+
+func TestAssertBodyField(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/users", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+
+	r, err := http.Post(u+"/users", "application/json", strings.NewReader(`{"user": {"id": 42, "tags": ["a", "b"]}}`))
+	assertResponse(t, 200, r, err)
+
+	if !s.AssertBodyField(ht, 0, "user.id", 42) {
+		t.Errorf("Expected s.AssertBodyField to pass")
+	}
+	if !s.AssertBodyField(ht, 0, "user.tags.1", "b") {
+		t.Errorf("Expected s.AssertBodyField to pass")
+	}
+	assertExpectedCalls(t, nil, ht.errors)
+
+	s.AssertBodyField(ht, 0, "user.id", 7)
+	s.AssertBodyField(ht, 0, "user.name", "bob")
+	s.AssertBodyField(ht, 1, "user.id", 42)
+	exp := []string{
+		"Server(testserver) call (0) expected user.id to be (7), got (42)",
+		"Server(testserver) call (0) body has no field name in user.name",
+		"Server(testserver) has no recorded call (1), got (1) calls",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestAssertQueryParam(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/items", Calls: 2, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+
+	r, err := http.Get(u + "/items?page=1")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/items?page=2")
+	assertResponse(t, 200, r, err)
+
+	if !s.AssertQueryParam(ht, 1, "page", "2") {
+		t.Errorf("Expected s.AssertQueryParam to pass")
+	}
+	assertExpectedCalls(t, nil, ht.errors)
+
+	s.AssertQueryParam(ht, 0, "page", "2")
+	s.AssertQueryParam(ht, 0, "sort", "asc")
+	exp := []string{
+		"Server(testserver) call (0) expected query param page to be (2), got (1)",
+		"Server(testserver) call (0) expected query param sort to be (asc), but it is missing",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerNow(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+	s.CatchAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r, err := http.Get(u)
+	assertResponse(t, 200, r, err)
+	now = now.Add(time.Hour)
+	r, err = http.Get(u)
+	assertResponse(t, 200, r, err)
+
+	calls := s.Recorded()
+	if got := calls[1].Time.Sub(calls[0].Time); got != time.Hour {
+		t.Errorf("Expected calls to be (1h) apart, got (%s)", got)
+	}
+}
+
+func TestServerSleep(t *testing.T) {
+	var (
+		u     string
+		m     sync.Mutex
+		slept []time.Duration
+	)
+	s := New("testserver", &u)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.Now = func() time.Time {
+		m.Lock()
+		defer m.Unlock()
+		return now
+	}
+	s.Sleep = func(ctx context.Context, d time.Duration) error {
+		m.Lock()
+		defer m.Unlock()
+		slept = append(slept, d)
+		now = now.Add(d)
+		return nil
+	}
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/slow", Calls: 1, Delay: time.Hour, Handler: RespondStatus(200)})
+
+	start := time.Now()
+	r, err := http.Get(u + "/slow")
+	assertResponse(t, 200, r, err)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected response without real waiting, took %s", d)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if len(slept) != 1 || slept[0] != time.Hour {
+		t.Errorf("Expected fake sleep of [1h], got %v", slept)
+	}
+	if d := s.Recorded()[0].Duration; d != time.Hour {
+		t.Errorf("Expected recorded duration of (1h), got (%s)", d)
+	}
+}
+
+func TestCallLog(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.CatchAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	http.Get(u + "/users")
+	http.Post(u+"/users", "application/json", strings.NewReader(`{"id": 1}`))
+	http.Get(u + "/users")
+	http.Get(u + "/groups")
+
+	log := s.Log()
+	if n := log.Count("GET", "/users"); n != 2 {
+		t.Errorf("Expected (2) calls to GET /users, got (%d)", n)
+	}
+	if n := log.Count("DELETE", "/users"); n != 0 {
+		t.Errorf("Expected (0) calls to DELETE /users, got (%d)", n)
+	}
+	if rc := log.First("POST", "/users"); rc == nil || string(rc.Body) != `{"id": 1}` {
+		t.Errorf("Expected first POST /users to be recorded, got (%v)", rc)
+	}
+	if rc := log.First("PUT", "/users"); rc != nil {
+		t.Errorf("Expected no PUT /users, got (%v)", rc)
+	}
+	gets := log.Filter(func(rc *RecordedCall) bool { return rc.Method == "GET" })
+	if len(gets) != 3 {
+		t.Errorf("Expected (3) GET calls, got (%d)", len(gets))
+	}
+}
+
+func TestAssertJSONResponse(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/sum", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var nums []int
+		json.NewDecoder(r.Body).Decode(&nums)
+		sum := 0
+		for _, n := range nums {
+			sum += n
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"sum": sum, "count": len(nums)})
+	})})
+
+	r, err := http.Post(u+"/sum", "application/json", strings.NewReader(`[1, 2, 3]`))
+	assertResponse(t, 201, r, err)
+
+	want := struct {
+		Count int `json:"count"`
+		Sum   int `json:"sum"`
+	}{3, 6}
+	if !s.AssertJSONResponse(ht, 0, want) {
+		t.Errorf("Expected s.AssertJSONResponse to pass")
+	}
+	assertExpectedCalls(t, nil, ht.errors)
+
+	s.AssertJSONResponse(ht, 0, map[string]int{"sum": 7, "count": 3})
+	exp := []string{
+		"Server(testserver) call (0) expected response (map[count:3 sum:7]), got (map[count:3 sum:6])",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+
+	if rc := s.Recorded()[0]; rc.StatusCode != 201 {
+		t.Errorf("Expected recorded status (201), got (%d)", rc.StatusCode)
+	}
+}
+
+func TestRequireBodyDrain(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.RequireBodyDrain = true
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/read", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+	})})
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/ignore", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/get", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/form", Calls: 1, Form: url.Values{"role": {"admin"}}, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+
+	r, err := http.PostForm(u+"/form", url.Values{"role": {"admin"}})
+	assertResponse(t, 200, r, err)
+	r, err = http.Post(u+"/read", "text/plain", strings.NewReader("hello"))
+	assertResponse(t, 200, r, err)
+	r, err = http.Post(u+"/ignore", "text/plain", strings.NewReader("hello"))
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/get")
+	assertResponse(t, 200, r, err)
+	r, err = http.Post(u+"/missing", "text/plain", strings.NewReader("hello"))
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		`Server(testserver) got (1) unexpected calls to POST /missing, first with body "hello"`,
+		"Server(testserver) handler for POST /form left (10) bytes of the request body unread",
+		"Server(testserver) handler for POST /ignore left (5) bytes of the request body unread",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestCountByFingerprint(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Fingerprint = func(r *http.Request) string {
+		return r.Method + " " + r.URL.Path + " " + r.Header.Get("X-Tenant")
+	}
+	s.CatchAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tenant := range []string{"acme", "globex", "acme"} {
+		req, _ := http.NewRequest("GET", u+"/reports", nil)
+		req.Header.Set("X-Tenant", tenant)
+		r, err := http.DefaultClient.Do(req)
+		assertResponse(t, 200, r, err)
+	}
+
+	if n := s.CountByFingerprint("GET /reports acme"); n != 2 {
+		t.Errorf("Expected (2) acme calls, got (%d)", n)
+	}
+	if n := s.CountByFingerprint("GET /reports globex"); n != 1 {
+		t.Errorf("Expected (1) globex calls, got (%d)", n)
+	}
+	if n := s.CountByFingerprint("GET /reports initech"); n != 0 {
+		t.Errorf("Expected (0) initech calls, got (%d)", n)
+	}
+}
+
+func TestAssertMinTLS(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.CatchAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	r, err := ts.Client().Get(ts.URL)
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u)
+	assertResponse(t, 200, r, err)
+
+	if !s.AssertMinTLS(ht, 0, tls.VersionTLS12) {
+		t.Errorf("Expected s.AssertMinTLS to pass")
+	}
+	assertExpectedCalls(t, nil, ht.errors)
+
+	s.AssertMinTLS(ht, 1, tls.VersionTLS12)
+	exp := []string{
+		"Server(testserver) call (1) expected TLS of at least TLS 1.2, got none",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestAssertEveryRequest(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.CatchAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, auth := range []string{"Bearer a", "", "Bearer c"} {
+		req, _ := http.NewRequest("GET", u+"/items", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		r, err := http.DefaultClient.Do(req)
+		assertResponse(t, 200, r, err)
+	}
+
+	hasAuth := func(r *http.Request) error {
+		if r.Header.Get("Authorization") == "" {
+			return errors.New("missing Authorization")
+		}
+		return nil
+	}
+	if s.AssertEveryRequest(ht, hasAuth) {
+		t.Errorf("Expected s.AssertEveryRequest to not pass")
+	}
+	exp := []string{
+		"Server(testserver) call (1) GET /items failed check: missing Authorization",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestAssertHandlerUnder(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.CatchAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+
+	r, err := http.Get(u)
+	assertResponse(t, 200, r, err)
+
+	if max := s.MaxHandlerDuration(); max < 50*time.Millisecond {
+		t.Errorf("Expected max duration of at least 50ms, got %s", max)
+	}
+	if !s.AssertHandlerUnder(ht, 200*time.Millisecond) {
+		t.Errorf("Expected s.AssertHandlerUnder to pass")
+	}
+	if s.AssertHandlerUnder(ht, 10*time.Millisecond) {
+		t.Errorf("Expected s.AssertHandlerUnder to not pass")
+	}
+	if len(ht.errors) != 1 {
+		t.Errorf("Expected (1) error, got (%d)", len(ht.errors))
+	}
+}
+
+func TestAssertMeanUnder(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.CatchAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := time.ParseDuration(r.URL.Query().Get("d"))
+		time.Sleep(d)
+	}))
+
+	if mean := s.MeanHandlerDuration(); mean != 0 {
+		t.Errorf("Expected zero mean duration without calls, got %s", mean)
+	}
+	for _, d := range []string{"0s", "10ms", "80ms"} {
+		r, err := http.Get(u + "?d=" + d)
+		assertResponse(t, 200, r, err)
+	}
+
+	if mean := s.MeanHandlerDuration(); mean < 30*time.Millisecond {
+		t.Errorf("Expected mean duration of at least 30ms, got %s", mean)
+	}
+	if !s.AssertMeanUnder(ht, 70*time.Millisecond) {
+		t.Errorf("Expected s.AssertMeanUnder to pass")
+	}
+	if s.AssertMeanUnder(ht, 20*time.Millisecond) {
+		t.Errorf("Expected s.AssertMeanUnder to not pass")
+	}
+	if len(ht.errors) != 1 {
+		t.Errorf("Expected (1) error, got (%d)", len(ht.errors))
+	}
+}
+
+func TestMaxRecordedCalls(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.MaxRecordedCalls = 3
+	s.CatchAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 8; i++ {
+		r, err := http.Get(u + "/" + strconv.Itoa(i))
+		assertResponse(t, 200, r, err)
+	}
+
+	var paths []string
+	for _, rc := range s.Recorded() {
+		paths = append(paths, rc.Path)
+	}
+	assertExpectedCalls(t, []string{"/5", "/6", "/7"}, paths)
+}
+
+func TestAssertResponsesValidJSON(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	respond := func(contentType, body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte(body))
+		})
+	}
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/good", Calls: 1, Handler: respond("application/json", `{"ok": true}`)})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/bad", Calls: 1, Handler: respond("application/problem+json; charset=utf-8", `{"ok": tru`)})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/text", Calls: 1, Handler: respond("text/plain", `{"ok": tru`)})
+
+	for _, p := range []string{"/good", "/bad", "/text"} {
+		r, err := http.Get(u + p)
+		assertResponse(t, 200, r, err)
+	}
+
+	if s.AssertResponsesValidJSON(ht) {
+		t.Errorf("Expected s.AssertResponsesValidJSON to not pass")
+	}
+	exp := []string{
+		`Server(testserver) call (1) GET /bad responded with invalid JSON: "{\"ok\": tru"`,
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestAssertStatusCount(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.CatchAll(RoundRobin(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	))
+
+	for _, code := range []int{503, 200, 200, 503} {
+		r, err := http.Get(u)
+		assertResponse(t, code, r, err)
+	}
+
+	counts := s.StatusCounts()
+	if len(counts) != 2 || counts[200] != 2 || counts[503] != 2 {
+		t.Errorf("Expected (2) 200s and (2) 503s, got %v", counts)
+	}
+	if !s.AssertStatusCount(ht, 503, 2) {
+		t.Errorf("Expected s.AssertStatusCount to pass")
+	}
+	if s.AssertStatusCount(ht, 500, 1) {
+		t.Errorf("Expected s.AssertStatusCount to not pass")
+	}
+	if len(ht.errors) != 1 {
+		t.Errorf("Expected (1) error, got (%d)", len(ht.errors))
+	}
+}
+
+func TestServerReceived(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	ec := &ExpectedCall{Method: "POST", Path: "/users", Calls: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+		}),
+	}
+	s.Expect(ec)
+
+	r, err := http.Post(u+"/users?notify=true", "application/json", strings.NewReader(`{"name":"alice"}`))
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/other")
+	assertResponse(t, 404, r, err)
+
+	if n := len(s.Received()); n != 2 {
+		t.Fatalf("Expected (2) received requests, got (%d)", n)
+	}
+	reqs := ec.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("Expected (1) request for POST /users, got (%d)", len(reqs))
+	}
+	req := reqs[0]
+	if req.URL.Query().Get("notify") != "true" || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected query and headers to be captured, got %s %s", req.URL, req.Header)
+	}
+	var user struct{ Name string }
+	if err := json.NewDecoder(req.Body).Decode(&user); err != nil || user.Name != "alice" {
+		t.Errorf("Expected captured body for alice, got %+v (%v)", user, err)
+	}
+	if b, _ := io.ReadAll(s.Received()[0].Body); string(b) != `{"name":"alice"}` {
+		t.Errorf("Expected body to be readable again, got (%s)", b)
+	}
+}
+
+func TestAssertIdempotencyKeyReused(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/payments", Calls: 2,
+		Handlers: []http.Handler{RespondStatus(503), RespondStatus(201)},
+		Matchers: []Matcher{WithIdempotencyKey("key-1")},
+	})
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/payments", Calls: 1, Handler: RespondStatus(201)})
+
+	post := func(key string, code int) {
+		req, _ := http.NewRequest("POST", u+"/payments", nil)
+		req.Header.Set("Idempotency-Key", key)
+		r, err := http.DefaultClient.Do(req)
+		assertResponse(t, code, r, err)
+	}
+	post("key-1", 503)
+	post("key-2", 201)
+
+	if s.AssertIdempotencyKeyReused(ht) {
+		t.Errorf("Expected s.AssertIdempotencyKeyReused to not pass")
+	}
+	exp := []string{
+		"Server(testserver) expected a request to reuse an Idempotency-Key, got (2) distinct keys",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+
+	post("key-1", 201)
+	if !s.AssertIdempotencyKeyReused(ht) {
+		t.Errorf("Expected s.AssertIdempotencyKeyReused to pass")
+	}
+}
+
+func TestServerDump(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.CatchAll(RespondStatus(204))
+
+	r, err := http.Get(u + "/users?page=2")
+	assertResponse(t, 204, r, err)
+	r, err = http.Post(u+"/users", "application/json", strings.NewReader(`{"name":"alice"}`))
+	assertResponse(t, 204, r, err)
+
+	var buf bytes.Buffer
+	s.Dump(&buf)
+	for _, want := range []string{
+		"Server(testserver) call (0):\nGET /users?page=2 HTTP/1.1\r\n",
+		"Server(testserver) call (1):\nPOST /users HTTP/1.1\r\n",
+		"Content-Type: application/json\r\n",
+		`{"name":"alice"}`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected dump to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestAssertHeaderBefore(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.CatchAll(RespondStatus(204))
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(u, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, req := range []string{
+		"POST /first HTTP/1.1\r\nHost: example.com\r\nX-Beta: 1\r\nContent-Length: 4\r\nX-Alpha: 2\r\n\r\nbody",
+		"GET /second HTTP/1.1\r\nHost: example.com\r\nx-alpha: 3\r\nX-Beta: 4\r\n\r\n",
+	} {
+		conn.Write([]byte(req))
+		r, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		assertResponse(t, 204, r, err)
+	}
+
+	calls := s.Recorded()
+	if len(calls) != 2 {
+		t.Fatalf("Expected (2) recorded calls, got (%d)", len(calls))
+	}
+	exp := []string{"Host: example.com", "X-Beta: 1", "Content-Length: 4", "X-Alpha: 2"}
+	if !reflect.DeepEqual(calls[0].RawHeaders, exp) {
+		t.Errorf("Expected raw headers %q, got %q", exp, calls[0].RawHeaders)
+	}
+	if !AssertHeaderBefore(ht, calls[0], "X-Beta", "X-Alpha") {
+		t.Errorf("Expected AssertHeaderBefore to pass")
+	}
+	if !AssertHeaderBefore(ht, calls[1], "X-Alpha", "X-Beta") {
+		t.Errorf("Expected AssertHeaderBefore to pass")
+	}
+	AssertHeaderBefore(ht, calls[0], "X-Alpha", "X-Beta")
+	AssertHeaderBefore(ht, calls[1], "X-Alpha", "X-Gamma")
+	exp = []string{
+		`POST /first expected header X-Alpha before X-Beta, got ["Host: example.com" "X-Beta: 1" "Content-Length: 4" "X-Alpha: 2"]`,
+		`GET /second expected headers X-Alpha and X-Gamma, got ["Host: example.com" "x-alpha: 3" "X-Beta: 4"]`,
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestRawHeadersIgnoreBody(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.CatchAll(RespondStatus(204))
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(u, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fake := "GET /b HTTP/1.1\r\nX-Fake: 1\r\n\r\n"
+	for _, req := range []string{
+		fmt.Sprintf("POST /a HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\n\r\n%s", len(fake), fake),
+		"GET /b HTTP/1.1\r\nHost: example.com\r\nX-Real: 1\r\n\r\n",
+	} {
+		conn.Write([]byte(req))
+		r, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		assertResponse(t, 204, r, err)
+	}
+
+	calls := s.Recorded()
+	if len(calls) != 2 {
+		t.Fatalf("Expected (2) recorded calls, got (%d)", len(calls))
+	}
+	exp := [][]string{
+		{"Host: example.com", "Content-Length: 30"},
+		{"Host: example.com", "X-Real: 1"},
+	}
+	for i, rc := range calls {
+		if !reflect.DeepEqual(rc.RawHeaders, exp[i]) {
+			t.Errorf("Expected raw headers %q for %s %s, got %q", exp[i], rc.Method, rc.Path, rc.RawHeaders)
+		}
+	}
+}
+
+func TestRawHeadersMiddleware(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Use(StatusEndpoint("/__s"))
+	s.CatchAll(RespondStatus(204))
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(u, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for _, tc := range []struct {
+		req  string
+		code int
+	}{
+		{"GET /__s HTTP/1.1\r\nHost: example.com\r\n\r\n", 200},
+		{"GET /a HTTP/1.1\r\nHost: example.com\r\nX-Real: 1\r\n\r\n", 204},
+	} {
+		conn.Write([]byte(tc.req))
+		r, err := http.ReadResponse(br, nil)
+		assertResponse(t, tc.code, r, err)
+		io.Copy(io.Discard, r.Body)
+	}
+
+	calls := s.Recorded()
+	if len(calls) != 1 {
+		t.Fatalf("Expected (1) recorded call, got (%d)", len(calls))
+	}
+	exp := []string{"Host: example.com", "X-Real: 1"}
+	if !reflect.DeepEqual(calls[0].RawHeaders, exp) {
+		t.Errorf("Expected raw headers %q, got %q", exp, calls[0].RawHeaders)
+	}
+}
@@ -5,17 +5,66 @@
 package httpassert
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
-// NotFound can be rewritten to return a different status code or other behavior
-var NotFound http.HandlerFunc = http.NotFound
+// NotFound can be rewritten to return a different status code or other behavior.
+// It is shared by every Server; prefer Server.NotFoundHandler.
+var NotFound http.HandlerFunc = defaultNotFound
 
-var testServers []*Server
+var defaultNotFound http.HandlerFunc = http.NotFound
+
+// ResetNotFound restores NotFound to its default. Tests which rewrite NotFound
+// should call it during cleanup so the change doesn't leak into other tests.
+func ResetNotFound() {
+	NotFound = defaultNotFound
+}
+
+// MethodOverrides are the methods a POST request may be rewritten to when
+// Server.HonorMethodOverride is set.
+var MethodOverrides = []string{"PUT", "PATCH", "DELETE"}
+
+// AnyMethod can be used as ExpectedCall.Method to match requests of any
+// method.
+const AnyMethod = "*"
+
+var (
+	testServers  []*Server
+	testServersM sync.Mutex
+)
+
+// registered returns a copy of the Servers checked by the package level
+// Assert, clearing them if clear is set.
+func registered(clear bool) []*Server {
+	testServersM.Lock()
+	defer testServersM.Unlock()
+
+	servers := append([]*Server(nil), testServers...)
+	if clear {
+		testServers = nil
+	}
+	return servers
+}
 
 // Assert is a package level convenience method to check if all Servers
 // created have been validated.
@@ -23,13 +72,53 @@ func Assert(t testing.TB) bool {
 	t.Helper()
 
 	pass := true
-	for _, s := range testServers {
+	for _, s := range registered(true) {
 		pass = s.Assert(t) && pass
 	}
-	testServers = nil
 	return pass
 }
 
+// Reset forgets every Server created so far, so the package level Assert only
+// reports on Servers created after it is called.
+func Reset() {
+	registered(true)
+}
+
+// CloseAll closes every registered Server and clears the registry.
+func CloseAll() {
+	for _, s := range registered(true) {
+		s.Close()
+	}
+}
+
+// WithTimeout runs fn and, if it hasn't returned after d, reports the pending
+// expectations of every registered Server before asserting and closing them.
+// It is a safety net for suites which would otherwise hang without
+// diagnostics. fn is left running if the timeout is exceeded.
+func WithTimeout(t testing.TB, d time.Duration, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(d):
+	}
+
+	for _, s := range registered(false) {
+		if pending := s.pending(); len(pending) > 0 {
+			t.Errorf("Server(%s) timeout of %s exceeded, pending:\n\t%s", s.Name, d, strings.Join(pending, "\n\t"))
+		}
+		s.Assert(t)
+		s.Close()
+	}
+}
+
 // Server is a mocking http server that keeps track of intended and unintended
 // calls. This allows for checking that http calls were made correctly and that
 // no other calls were made unintentionally.
@@ -39,123 +128,1573 @@ type Server struct {
 	ExpectedCalls []*ExpectedCall
 	middleware    []Middleware
 
+	// NotFoundHandler serves unexpected calls and expectations without a
+	// Handler. It defaults to the package level NotFound, but unlike it
+	// isn't shared with other servers.
+	NotFoundHandler http.Handler
+
+	// Fallbacks are tried in order for requests which match no expectation
+	// or CatchAll, until one writes a response. A fallback declines a
+	// request by writing nothing. Requests served by a fallback are not
+	// unexpected calls.
+	Fallbacks []http.Handler
+
+	// Passthrough, when set, is a backend which requests not served by an
+	// expectation, CatchAll or Fallbacks are reverse proxied to, rather than
+	// being unexpected calls.
+	Passthrough *url.URL
+
+	// HonorMethodOverride rewrites the method of POST requests from the
+	// X-HTTP-Method-Override header before matching. Only methods listed in
+	// MethodOverrides are honored.
+	HonorMethodOverride bool
+
+	// MethodNotAllowed responds 405 with an Allow header, rather than
+	// NotFound, to unexpected calls whose path matches an expectation for a
+	// different method.
+	MethodNotAllowed bool
+
+	// CleanPaths matches requests as if their path had been through
+	// path.Clean, so "/a//b" and "/a/./b" match "/a/b". As with net/http a
+	// trailing slash is kept. Handlers still see the original path.
+	CleanPaths bool
+
+	// SortErrors sorts the failures reported by Check and Assert by method
+	// then path, rather than by registration order.
+	SortErrors bool
+
+	// ForceHTTP10 buffers responses so they are sent with a Content-Length
+	// rather than chunked, and with Connection: close, as an HTTP/1.0 server
+	// would.
+	ForceHTTP10 bool
+
+	// RequireBodyDrain makes Assert fail when a handler didn't read the whole
+	// request body.
+	RequireBodyDrain bool
+
+	// StrictResponses makes Assert fail when a handler calls WriteHeader
+	// more than once, or after Write. The extra calls are dropped.
+	StrictResponses bool
+
+	// ResponseMiddleware, when set, transforms the ResponseWriter of every
+	// call before it is dispatched, e.g. to add a header to all responses.
+	ResponseMiddleware func(http.ResponseWriter) http.ResponseWriter
+
+	// MaxRecordedCalls limits how many calls are recorded, keeping only the
+	// most recent. Zero means unlimited.
+	MaxRecordedCalls int
+
+	// Fingerprint, when set, computes an identity for each request which is
+	// stored on its RecordedCall and tallied by CountByFingerprint.
+	Fingerprint func(*http.Request) string
+
+	// Now and Sleep can be replaced with a fake clock so timing related
+	// behavior is reproducible. They default to time.Now and a context aware
+	// time.Sleep.
+	Now   func() time.Time
+	Sleep func(ctx context.Context, d time.Duration) error
+
+	catchAll      *ExpectedCall
+	paused        chan struct{}
+	closed        bool
+	changed       chan struct{}
+	calls         []*RecordedCall
+	orders        []map[*ExpectedCall]int
+	warnings      []string
+	bytesReceived int64
+	bytesSent     int64
+	asserted      bool
+	reported      map[testing.TB]map[string]bool
+
 	m sync.Mutex
 }
 
 // New creates a new Server using httptest, starts listening and writes the address to url.
+// url may be nil, in which case the address is available from Server.URL.
 func New(name string, url *string) *Server {
+	return register(newServer(name, false), url)
+}
+
+// NewTLS creates a new Server like New, but serving HTTPS with a self-signed
+// certificate. Use Server.Client for a client which trusts it.
+func NewTLS(name string, url *string) *Server {
+	return register(newServer(name, true), url)
+}
+
+// register writes the address of s to url, if not nil, and registers s for
+// the package level Assert.
+func register(s *Server, url *string) *Server {
+	if url != nil {
+		*url = s.URL()
+	}
+
+	testServersM.Lock()
+	defer testServersM.Unlock()
+
+	testServers = append(testServers, s)
+	return s
+}
+
+// NewT creates a new Server like New, returning its URL. Rather than being
+// registered for the package level Assert, the server is closed and asserted
+// when t finishes.
+func NewT(t testing.TB, name string) (*Server, string) {
+	t.Helper()
+
+	s := newServer(name, false)
+	t.Cleanup(func() {
+		s.Close()
+		s.Assert(t)
+	})
+	return s, s.URL()
+}
+
+func newServer(name string, tls bool) *Server {
 	s := new(Server)
 
-	hs := httptest.NewServer(s)
-	*url = hs.URL
+	hs := httptest.NewUnstartedServer(s)
+	if tls {
+		hs.StartTLS()
+	} else {
+		hs.Listener = &rawListener{Listener: hs.Listener}
+		hs.Config.ConnContext = rawConnContext
+		hs.Start()
+	}
 
 	s.Name = name
 	s.Server = hs
-
-	// register
-	testServers = append(testServers, s)
 	return s
 }
 
+// URL returns the base URL of the server.
+func (s *Server) URL() string {
+	return s.Server.URL
+}
+
+// Client returns an HTTP client configured for the server, which trusts its
+// certificate if it serves HTTPS.
+func (s *Server) Client() *http.Client {
+	return s.Server.Client()
+}
+
 // Use adds middleware wrapping the server.
 func (s *Server) Use(ms ...Middleware) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
 	s.middleware = append(s.middleware, ms...)
 }
 
 // ServeHTTP implements http.Handler
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var h http.Handler = http.HandlerFunc(s.serveHTTP)
-	for i := len(s.middleware); i > 0; i-- {
-		h = s.middleware[i-1](h)
+	r = r.WithContext(context.WithValue(r.Context(), serverKey{}, s))
+
+	// Capturing resumes once the body is consumed, even if middleware
+	// responds without reaching serveHTTP.
+	raw, body := rawHeaders(r), r.Body
+	defer func() {
+		if body != nil {
+			io.Copy(io.Discard, body)
+		}
+		resumeRawHeaders(r)
+	}()
+
+	s.m.Lock()
+	mw := s.middleware
+	s.m.Unlock()
+
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveHTTP(w, r, raw)
+	})
+	for i := len(mw); i > 0; i-- {
+		h = mw[i-1](h)
 	}
 	h.ServeHTTP(w, r)
 }
 
-func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
-	for i := range s.ExpectedCalls {
-		if s.ExpectedCalls[i].Match(r) {
-			s.ExpectedCalls[i].ServeHTTP(w, r)
+type serverKey struct{}
+
+// serverFromContext returns the Server handling the request with ctx, for use
+// by middleware.
+func serverFromContext(ctx context.Context) *Server {
+	s, _ := ctx.Value(serverKey{}).(*Server)
+	return s
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request, raw []string) {
+	if !s.wait(r.Context()) {
+		return
+	}
+
+	body := &bodyRecorder{ReadCloser: r.Body}
+	r.Body = body
+	rw := &responseRecorder{ResponseWriter: w}
+	w = rw
+	r = r.WithContext(context.WithValue(r.Context(), recorderKey{}, rw))
+	start := s.now()
+	var ec *ExpectedCall
+	defer func() {
+		s.record(rw, r, raw, body, start, ec)
+	}()
+
+	if s.ForceHTTP10 {
+		bw := &bufferedResponseWriter{ResponseWriter: w}
+		defer bw.flush()
+		w = bw
+	}
+
+	if s.StrictResponses {
+		w = &strictResponseWriter{ResponseWriter: w, s: s, r: r}
+	}
+	if s.ResponseMiddleware != nil {
+		w = s.ResponseMiddleware(w)
+	}
+
+	if s.HonorMethodOverride {
+		overrideMethod(r)
+	}
+
+	ec = s.dispatch(w, r)
+}
+
+// dispatch serves r with the first matching expectation, or as an unexpected
+// call, and returns the ExpectedCall used.
+func (s *Server) dispatch(w http.ResponseWriter, r *http.Request) *ExpectedCall {
+	if ec := s.match(r); ec != nil {
+		ec.ServeHTTP(w, r)
+		return ec
+	}
+	if s.MethodNotAllowed {
+		if allow := s.allowedMethods(r); len(allow) > 0 {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			ec := s.unexpectedCall(r)
+			ec.Increment(-1)
+			return ec
+		}
+	}
+	s.m.Lock()
+	catchAll := s.catchAll
+	s.m.Unlock()
+
+	if catchAll != nil && catchAll.Match(r) {
+		catchAll.ServeHTTP(w, r)
+		return catchAll
+	}
+	for _, h := range s.Fallbacks {
+		fw := &fallbackWriter{ResponseWriter: w}
+		h.ServeHTTP(fw, r)
+		if fw.wrote {
+			return nil
+		}
+	}
+	if s.Passthrough != nil {
+		httputil.NewSingleHostReverseProxy(s.Passthrough).ServeHTTP(w, r)
+		return nil
+	}
+	ec := s.unexpectedCall(r)
+	ec.ServeHTTP(w, r)
+	return ec
+}
+
+// match returns the most specific expectation matching r, see specificity,
+// or nil. Of equally specific expectations the first added wins.
+func (s *Server) match(r *http.Request) *ExpectedCall {
+	if s.CleanPaths {
+		p, raw := r.URL.Path, r.URL.RawPath
+		r.URL.Path, r.URL.RawPath = cleanPath(p), ""
+		defer func() { r.URL.Path, r.URL.RawPath = p, raw }()
+	}
+
+	var (
+		best       *ExpectedCall
+		rank, size int
+	)
+	for _, ec := range s.expectations() {
+		if ec.unexpected || !ec.Match(r) {
+			continue
+		}
+		if rk, sz := ec.specificity(); best == nil || rk > rank || rk == rank && sz > size {
+			best, rank, size = ec, rk, sz
+		}
+	}
+	return best
+}
+
+// cleanPath returns the canonical form of p, keeping a trailing slash like
+// net/http does.
+func cleanPath(p string) string {
+	np := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// expectations returns a copy of ExpectedCalls which can be used without
+// holding the lock.
+func (s *Server) expectations() []*ExpectedCall {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return append([]*ExpectedCall(nil), s.ExpectedCalls...)
+}
+
+// allowedMethods returns the sorted methods of expectations whose path
+// matches r.
+func (s *Server) allowedMethods(r *http.Request) []string {
+	var allow []string
+	for _, ec := range s.expectations() {
+		if ec.unexpected || ec.Method == AnyMethod || !ec.matchPath(r) {
+			continue
+		}
+		i := sort.SearchStrings(allow, ec.Method)
+		if i < len(allow) && allow[i] == ec.Method {
+			continue
+		}
+		allow = append(allow, "")
+		copy(allow[i+1:], allow[i:])
+		allow[i] = ec.Method
+	}
+	return allow
+}
+
+func (s *Server) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// sleep pauses for d, returning early with the context's error if ctx is done
+// first.
+func (s *Server) sleep(ctx context.Context, d time.Duration) error {
+	if s.Sleep != nil {
+		return s.Sleep(ctx, d)
+	}
+	return sleepContext(ctx, d)
+}
+
+// sleepContext waits for d, returning early with ctx's error if it is done
+// first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause blocks incoming requests until Resume is called, simulating an
+// unresponsive upstream. Blocked requests whose context is canceled, or which
+// are still blocked when the server is closed, are dropped without being
+// matched or recorded.
+func (s *Server) Pause() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.paused == nil {
+		s.paused = make(chan struct{})
+	}
+}
+
+// Resume releases requests blocked by Pause.
+func (s *Server) Resume() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.paused != nil {
+		close(s.paused)
+		s.paused = nil
+	}
+}
+
+// wait blocks while the server is paused, returning false if ctx is done or
+// the server is closed first.
+func (s *Server) wait(ctx context.Context) bool {
+	s.m.Lock()
+	paused := s.paused
+	s.m.Unlock()
+
+	if paused == nil {
+		return true
+	}
+	select {
+	case <-paused:
+	case <-ctx.Done():
+		return false
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return !s.closed && ctx.Err() == nil
+}
+
+// overrideMethod rewrites r.Method from the X-HTTP-Method-Override header.
+func overrideMethod(r *http.Request) {
+	if r.Method != "POST" {
+		return
+	}
+	m := strings.ToUpper(r.Header.Get("X-HTTP-Method-Override"))
+	for _, o := range MethodOverrides {
+		if m == o {
+			r.Method = m
 			return
 		}
 	}
+}
+
+// unexpectedCall returns the ExpectedCall tracking unexpected calls to
+// r.Method and r.URL.Path, registering a new one if needed. Repeated
+// identical calls share a single entry.
+func (s *Server) unexpectedCall(r *http.Request) *ExpectedCall {
+	var body string
+	if b, _ := readBody(r); len(b) > 0 {
+		body = snippet(b)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, ec := range s.ExpectedCalls {
+		if ec.unexpected && ec.Method == r.Method && ec.Path == r.URL.Path {
+			return ec
+		}
+	}
 	ec := &ExpectedCall{
-		Method: r.Method,
-		Path:   r.URL.Path,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		unexpected: true,
+		body:       body,
+		server:     s,
 	}
-	ec.ServeHTTP(w, r)
-	s.Expect(ec)
+	s.ExpectedCalls = append(s.ExpectedCalls, ec)
+	return ec
 }
 
-// Assert checks that the correct number of expected calls was made
+// Assert checks that the correct number of expected calls was made. Failures
+// already reported to t by a previous Assert are not reported again, though
+// they still cause it to return false.
 func (s *Server) Assert(t testing.TB) bool {
 	t.Helper()
-	pass := true
 
-	for _, ec := range s.ExpectedCalls {
-		if ec.Calls < 0 {
-			t.Errorf(
-				"Server(%s) got (%d) unexpected calls to %s %s",
-				s.Name, -ec.Calls, ec.Method, ec.Path,
-			)
-			pass = false
+	errs := s.Check()
+
+	s.m.Lock()
+	s.asserted = true
+	if s.reported == nil {
+		s.reported = make(map[testing.TB]map[string]bool)
+	}
+	reported := s.reported[t]
+	if reported == nil {
+		reported = make(map[string]bool)
+		s.reported[t] = reported
+	}
+	var report []string
+	for _, err := range errs {
+		if !reported[err] {
+			reported[err] = true
+			report = append(report, err)
 		}
-		if ec.Calls > 0 {
-			t.Errorf(
-				"Server(%s) expected (%d) more calls to %s %s",
-				s.Name, ec.Calls, ec.Method, ec.Path,
-			)
-			pass = false
+	}
+	s.m.Unlock()
+
+	for _, err := range report {
+		t.Errorf("%s", err)
+	}
+	return len(errs) == 0
+}
+
+// AssertCall checks, mid-test, that the expectation for method and path has
+// received all the calls it expects so far.
+func (s *Server) AssertCall(t testing.TB, method, path string) bool {
+	t.Helper()
+
+	for _, ec := range s.expectations() {
+		if ec.unexpected || ec.Method != method || ec.Path != path {
+			continue
 		}
+		if !ec.Satisfied() {
+			t.Errorf("Server(%s) expected %s %s to be satisfied, (%d) calls pending", s.Name, method, path, ec.pendingCalls())
+			return false
+		}
+		return true
 	}
-	return pass
+	t.Errorf("Server(%s) has no expectation for %s %s", s.Name, method, path)
+	return false
 }
 
-// Close closes the listener
-func (s *Server) Close() {
-	s.Server.Close()
+// AssertOrder checks that expectations were called in the order they were
+// declared: once a call to one expectation has been made, no calls to earlier
+// expectations may follow. Unexpected calls are ignored.
+func (s *Server) AssertOrder(t testing.TB) bool {
+	t.Helper()
+
+	s.m.Lock()
+	declared := make(map[*ExpectedCall]int)
+	for i, ec := range s.ExpectedCalls {
+		if !ec.unexpected {
+			declared[ec] = i
+		}
+	}
+	s.m.Unlock()
+
+	return s.assertSequence(t, declared)
 }
 
-// Expect adds an ExpectedCall to available calls
-func (s *Server) Expect(ec *ExpectedCall) {
+// assertSequence checks that the recorded calls to expectations in steps were
+// made in nondecreasing step order.
+func (s *Server) assertSequence(t testing.TB, steps map[*ExpectedCall]int) bool {
+	t.Helper()
+
+	errs := s.sequenceErrors(steps)
+	for _, err := range errs {
+		t.Errorf("%s", err)
+	}
+	return len(errs) == 0
+}
+
+// sequenceErrors returns an error for each recorded call to an expectation in
+// steps which was made after a call to a later step.
+func (s *Server) sequenceErrors(steps map[*ExpectedCall]int) []string {
+	var errs []string
+
+	var last *ExpectedCall
+	for _, rc := range s.Recorded() {
+		step, ok := steps[rc.Expectation]
+		if !ok {
+			continue
+		}
+		if last != nil && step < steps[last] {
+			errs = append(errs, fmt.Sprintf(
+				"Server(%s) got %s %s (step %d) after %s %s (step %d)",
+				s.Name, rc.Expectation.Method, rc.Expectation.Path, step+1,
+				last.Method, last.Path, steps[last]+1,
+			))
+			continue
+		}
+		last = rc.Expectation
+	}
+	return errs
+}
+
+// InOrder declares that calls, which should already be expected, must be
+// made in the given order. Assert reports any call made after a call to a
+// later step.
+func (s *Server) InOrder(calls ...*ExpectedCall) {
+	steps := make(map[*ExpectedCall]int, len(calls))
+	for i, ec := range calls {
+		steps[ec] = i
+	}
+
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	s.ExpectedCalls = append(s.ExpectedCalls, ec)
+	s.orders = append(s.orders, steps)
 }
 
-// ExpectedCall sets up simple Method and route prefix checking. Any advanced
-// checks should be done in the handler.
-type ExpectedCall struct {
-	Method  string
-	Path    string
-	Handler http.Handler
-	Calls   int
+// Asserted reports whether Assert has been called.
+func (s *Server) Asserted() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
 
-	m sync.Mutex
+	return s.asserted
 }
 
-// Match matches on r.Method and r.URL.Path prefix. More extensive matching can be done in Handler.
-func (ec *ExpectedCall) Match(r *http.Request) bool {
-	return ec.Method == r.Method && strings.HasPrefix(r.URL.Path, ec.Path)
+// Check returns the failures Assert would report, without reporting them.
+func (s *Server) Check() []string {
+	ecs := s.expectations()
+	if s.SortErrors {
+		sort.SliceStable(ecs, func(i, j int) bool {
+			if ecs[i].Method != ecs[j].Method {
+				return ecs[i].Method < ecs[j].Method
+			}
+			return ecs[i].Path < ecs[j].Path
+		})
+	}
+
+	var errs []string
+	for _, ec := range ecs {
+		errs = append(errs, s.callErrors(ec)...)
+	}
+
+	s.m.Lock()
+	orders := s.orders
+	warnings := append([]string(nil), s.warnings...)
+	s.m.Unlock()
+
+	for _, steps := range orders {
+		errs = append(errs, s.sequenceErrors(steps)...)
+	}
+	return append(errs, warnings...)
 }
 
-// ServeHTTP implements http.Handler
-func (ec *ExpectedCall) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h := ec.Handler
-	if h == nil {
-		h = NotFound
+// AssertSubtests is like Assert but checks each expectation in its own
+// subtest, named after its method and path.
+func (s *Server) AssertSubtests(t *testing.T) bool {
+	t.Helper()
+	pass := true
+
+	for _, ec := range s.expectations() {
+		ec := ec
+		pass = t.Run(ec.Method+" "+ec.Path, func(t *testing.T) {
+			s.assertCall(t, ec)
+		}) && pass
 	}
-	h.ServeHTTP(w, r)
-	ec.Increment(-1)
+	return pass
 }
 
-// Increment allows changing Calls in a thread-safe way.
-// use negative numbers to decrement.
-func (ec *ExpectedCall) Increment(i int) {
-	ec.m.Lock()
-	defer ec.m.Unlock()
+// AssertTag is like Assert but only checks expectations tagged with tag.
+func (s *Server) AssertTag(t testing.TB, tag string) bool {
+	t.Helper()
+	pass := true
 
-	ec.Calls += i
+	for _, ec := range s.expectations() {
+		if ec.hasTag(tag) {
+			pass = s.assertCall(t, ec) && pass
+		}
+	}
+	return pass
+}
+
+func (s *Server) assertCall(t testing.TB, ec *ExpectedCall) bool {
+	t.Helper()
+
+	errs := s.callErrors(ec)
+	for _, err := range errs {
+		t.Errorf("%s", err)
+	}
+	return len(errs) == 0
+}
+
+// callErrors describes how ec's calls were wrong, if they were.
+func (s *Server) callErrors(ec *ExpectedCall) []string {
+	var errs []string
+	if err := s.callError(ec); err != "" {
+		errs = append(errs, err)
+	}
+	if n := ec.maxInWindow(); ec.Window > 0 && n > ec.WindowCalls {
+		errs = append(errs, fmt.Sprintf(
+			"Server(%s) got (%d) calls to %s %s within %s, expected at most (%d)",
+			s.Name, n, ec.Method, ec.Path, ec.Window, ec.WindowCalls,
+		))
+	}
+	return errs
+}
+
+func (s *Server) callError(ec *ExpectedCall) string {
+	if ec.AnyTimes {
+		return ""
+	}
+	if ec.ranged() {
+		n := ec.received()
+		if n < ec.MinCalls {
+			return fmt.Sprintf(
+				"Server(%s) expected at least (%d) calls to %s %s, got (%d)",
+				s.Name, ec.MinCalls, ec.Method, ec.Path, n,
+			)
+		}
+		if ec.MaxCalls > 0 && n > ec.MaxCalls {
+			return fmt.Sprintf(
+				"Server(%s) expected at most (%d) calls to %s %s, got (%d)",
+				s.Name, ec.MaxCalls, ec.Method, ec.Path, n,
+			)
+		}
+		return ""
+	}
+	calls := ec.remaining()
+	if -ec.Tolerance <= calls && calls <= ec.Tolerance {
+		return ""
+	}
+	if calls < 0 && ec.body != "" {
+		return fmt.Sprintf(
+			"Server(%s) got (%d) unexpected calls to %s %s, first with body %s",
+			s.Name, -calls, ec.Method, ec.Path, ec.body,
+		)
+	}
+	if calls < 0 {
+		return fmt.Sprintf(
+			"Server(%s) got (%d) unexpected calls to %s %s",
+			s.Name, -calls, ec.Method, ec.Path,
+		)
+	}
+	if calls > 0 {
+		return fmt.Sprintf(
+			"Server(%s) expected (%d) more calls to %s %s",
+			s.Name, calls, ec.Method, ec.Path,
+		)
+	}
+	return ""
+}
+
+// Deadline reports an error listing the pending expectations if any remain
+// unmet after d. This catches tests where the client never calls the mock.
+// The timer is stopped when the test finishes.
+func (s *Server) Deadline(t testing.TB, d time.Duration) {
+	var (
+		m    sync.Mutex
+		done bool
+	)
+	timer := time.AfterFunc(d, func() {
+		m.Lock()
+		defer m.Unlock()
+
+		if done {
+			return
+		}
+		if pending := s.pending(); len(pending) > 0 {
+			t.Errorf("Server(%s) deadline of %s exceeded, pending:\n\t%s", s.Name, d, strings.Join(pending, "\n\t"))
+		}
+	})
+	t.Cleanup(func() {
+		m.Lock()
+		defer m.Unlock()
+
+		done = true
+		timer.Stop()
+	})
+}
+
+// pending describes the expectations still waiting for calls.
+func (s *Server) pending() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var pending []string
+	for _, ec := range s.ExpectedCalls {
+		if n := ec.pendingCalls(); n > 0 {
+			pending = append(pending, fmt.Sprintf("(%d) calls to %s %s", n, ec.Method, ec.Path))
+		}
+	}
+	return pending
+}
+
+// WaitFor blocks until no expectations have pending calls, returning true, or
+// until timeout elapses, returning false. It is useful when the code under
+// test makes its calls from other goroutines.
+func (s *Server) WaitFor(timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		s.m.Lock()
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.m.Unlock()
+
+		if len(s.pending()) == 0 {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// signal wakes any WaitFor calls to recheck the pending expectations.
+func (s *Server) signal() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// Close closes the listener and removes s from the Servers checked by the
+// package level Assert. Requests blocked by Pause are dropped.
+func (s *Server) Close() {
+	s.m.Lock()
+	s.closed = true
+	if s.paused != nil {
+		close(s.paused)
+		s.paused = nil
+	}
+	s.m.Unlock()
+
+	s.Server.Close()
+	deregister(s)
+}
+
+// deregister removes s from the Servers checked by the package level Assert.
+func deregister(s *Server) {
+	testServersM.Lock()
+	defer testServersM.Unlock()
+
+	var servers []*Server
+	for _, ts := range testServers {
+		if ts != s {
+			servers = append(servers, ts)
+		}
+	}
+	testServers = servers
+}
+
+// Expect adds an ExpectedCall to available calls
+func (s *Server) Expect(ec *ExpectedCall) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ec.server = s
+	s.ExpectedCalls = append(s.ExpectedCalls, ec)
+}
+
+// Merge moves other's expectations and middleware to s, so a single server
+// can fill both roles. other is closed, so calls still made to its URL fail
+// rather than going unnoticed, and should not be used afterwards.
+func (s *Server) Merge(other *Server) {
+	other.m.Lock()
+	ecs, mw := other.ExpectedCalls, other.middleware
+	other.ExpectedCalls, other.middleware = nil, nil
+	other.m.Unlock()
+	other.Close()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, ec := range ecs {
+		ec.server = s
+	}
+	s.ExpectedCalls = append(s.ExpectedCalls, ecs...)
+	s.middleware = append(s.middleware, mw...)
+}
+
+// Handle registers and returns an expectation for calls to method and path,
+// served by h wrapped in mw.
+func (s *Server) Handle(method, path string, mw []Middleware, h http.Handler, calls int) *ExpectedCall {
+	ec := &ExpectedCall{
+		Method:     method,
+		Path:       path,
+		Handler:    h,
+		Calls:      calls,
+		Middleware: mw,
+	}
+	s.Expect(ec)
+	return ec
+}
+
+// Routes registers an expectation for each entry in routes, which may be
+// called any number of times. Keys are an exact path, matching any method, or
+// a method and path separated by a space, e.g. "POST /users". Expectations are
+// registered in key order.
+func (s *Server) Routes(routes map[string]http.Handler) []*ExpectedCall {
+	keys := make([]string, 0, len(routes))
+	for k := range routes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ecs := make([]*ExpectedCall, 0, len(keys))
+	for _, k := range keys {
+		method, path := AnyMethod, k
+		if i := strings.IndexByte(k, ' '); i >= 0 {
+			method, path = k[:i], strings.TrimSpace(k[i+1:])
+		}
+		ec := &ExpectedCall{
+			Method:    method,
+			Path:      path,
+			ExactPath: true,
+			Handler:   routes[k],
+			AnyTimes:  true,
+		}
+		s.Expect(ec)
+		ecs = append(ecs, ec)
+	}
+	return ecs
+}
+
+// CatchAll installs a lowest priority expectation which serves every request
+// not matched by another expectation with h. It may be called any number of
+// times, turning the Server into a permissive recorder.
+func (s *Server) CatchAll(h http.Handler) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.catchAll = &ExpectedCall{
+		Path:      "/",
+		Handler:   h,
+		AnyTimes:  true,
+		MatchFunc: func(*http.Request) bool { return true },
+		server:    s,
+	}
+}
+
+// ExpectedCall sets up simple Method and route prefix checking. Any advanced
+// checks should be done in the handler.
+type ExpectedCall struct {
+	Method  string
+	Path    string
+	Handler http.Handler
+	Calls   int
+
+	// Handlers, when Handler is nil, serve successive calls in order. The
+	// last one serves any calls beyond len(Handlers).
+	Handlers []http.Handler
+
+	// HandlerFuncE is used when Handler and Handlers are nil. If it returns an error, the
+	// error text is written with a 500 status.
+	HandlerFuncE func(http.ResponseWriter, *http.Request) error
+
+	// ExactPath requires the request path to equal Path (or EscapedPath)
+	// rather than have it as a prefix.
+	ExactPath bool
+
+	// PathRegexp, when set, is matched against r.URL.Path instead of Path.
+	PathRegexp *regexp.Regexp
+
+	// RequestURI, when set, must equal the raw r.RequestURI, including the
+	// query, instead of Path being a prefix of r.URL.Path.
+	RequestURI string
+
+	// EscapedPath, when set, must be a prefix of r.URL.EscapedPath() instead
+	// of Path being a prefix of the decoded r.URL.Path. This distinguishes
+	// "/a%2Fb" from "/a/b".
+	EscapedPath string
+
+	// Query values must all be present on the request. Other query
+	// parameters are ignored.
+	Query url.Values
+
+	// Header values must all be present on the request. Keys are case
+	// insensitive and other headers are ignored.
+	Header http.Header
+
+	// Form values must all be present in the url-encoded request body. The
+	// body is restored for Handler.
+	Form url.Values
+
+	// BodySHA256, when set, must equal the hex SHA-256 digest of the request
+	// body. The body is restored for Handler.
+	BodySHA256 string
+
+	// BodyMatchFunc, when set, must report true for the request body. The
+	// body is restored for Handler.
+	BodyMatchFunc func(body []byte) bool
+
+	// Tolerance allows Calls to be off by up to Tolerance in either
+	// direction, for clients known to occasionally retry.
+	Tolerance int
+
+	// AnyTimes allows the call to be made any number of times, including
+	// none. Calls is still decremented but never checked.
+	AnyTimes bool
+
+	// MinCalls and MaxCalls, when either is set, replace the exact Calls
+	// check with a range. A zero MaxCalls leaves the range unbounded above.
+	MinCalls int
+	MaxCalls int
+
+	// MatchFunc, when set, is used instead of the Method and path checks.
+	// The remaining checks, such as Query, Header and Matchers, still apply.
+	MatchFunc func(*http.Request) bool
+
+	// Matchers are additional checks which must all pass for a request to
+	// match.
+	Matchers []Matcher
+
+	// Middleware wraps Handler for this call only.
+	Middleware []Middleware
+
+	// Window and WindowCalls limit the rate of calls: Assert fails if more
+	// than WindowCalls arrive within any Window.
+	Window      time.Duration
+	WindowCalls int
+
+	// Gzip compresses the response when the client accepts gzip.
+	Gzip bool
+
+	// ReadDelay is how long the first read of the request body blocks for,
+	// according to Server.Sleep, to simulate a stalled upload.
+	ReadDelay time.Duration
+
+	// Delay is how long to wait before serving a call, according to
+	// Server.Sleep. If the request's context is done first, nothing is
+	// written and the call doesn't count towards Calls.
+	Delay time.Duration
+
+	// Tags group expectations so they can be checked with Server.AssertTag.
+	Tags []string
+
+	unexpected bool
+	body       string
+	server     *Server
+	times      []time.Time
+
+	m sync.Mutex
+}
+
+// Match matches on r.Method (any method if Method is AnyMethod) and
+// r.URL.Path prefix (or RequestURI, PathRegexp or EscapedPath), or MatchFunc
+// if set, as well as Query, Header and any Matchers. More extensive matching can be done in Handler.
+func (ec *ExpectedCall) Match(r *http.Request) bool {
+	if ec.MatchFunc != nil {
+		if !ec.MatchFunc(r) {
+			return false
+		}
+	} else if !ec.matchMethod(r) || !ec.matchPath(r) {
+		return false
+	}
+	if len(ec.Query) > 0 && !containsValues(r.URL.Query(), ec.Query) {
+		return false
+	}
+	if len(ec.Header) > 0 && !containsHeader(r.Header, ec.Header) {
+		return false
+	}
+	if len(ec.Form) > 0 && !matchForm(r, ec.Form) {
+		return false
+	}
+	if ec.BodySHA256 != "" && !matchSHA256(r, ec.BodySHA256) {
+		return false
+	}
+	if ec.BodyMatchFunc != nil {
+		if b, err := readBody(r); err != nil || !ec.BodyMatchFunc(b) {
+			return false
+		}
+	}
+	for _, m := range ec.Matchers {
+		if !m(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a copy of ec with Calls reset to zero. Slices are copied so
+// the clone can be modified without affecting ec.
+func (ec *ExpectedCall) Clone() *ExpectedCall {
+	return &ExpectedCall{
+		Method:        ec.Method,
+		Path:          ec.Path,
+		ExactPath:     ec.ExactPath,
+		PathRegexp:    ec.PathRegexp,
+		RequestURI:    ec.RequestURI,
+		EscapedPath:   ec.EscapedPath,
+		Query:         cloneValues(ec.Query),
+		Header:        ec.Header.Clone(),
+		Form:          cloneValues(ec.Form),
+		BodySHA256:    ec.BodySHA256,
+		BodyMatchFunc: ec.BodyMatchFunc,
+		Handler:       ec.Handler,
+		Handlers:      append([]http.Handler(nil), ec.Handlers...),
+		HandlerFuncE:  ec.HandlerFuncE,
+		Tolerance:     ec.Tolerance,
+		AnyTimes:      ec.AnyTimes,
+		MinCalls:      ec.MinCalls,
+		MaxCalls:      ec.MaxCalls,
+		Window:        ec.Window,
+		WindowCalls:   ec.WindowCalls,
+		MatchFunc:     ec.MatchFunc,
+		Matchers:      append([]Matcher(nil), ec.Matchers...),
+		Middleware:    append([]Middleware(nil), ec.Middleware...),
+		Gzip:          ec.Gzip,
+		ReadDelay:     ec.ReadDelay,
+		Delay:         ec.Delay,
+		Tags:          append([]string(nil), ec.Tags...),
+	}
+}
+
+// specificity ranks how precisely ec matches requests, so the most specific
+// of several matching expectations is used: exact paths rank above prefixes,
+// which rank above PathRegexp and then MatchFunc. Within a rank, longer paths
+// are more specific.
+func (ec *ExpectedCall) specificity() (rank, size int) {
+	switch {
+	case ec.MatchFunc != nil:
+		return 0, 0
+	case ec.RequestURI != "":
+		return 3, len(ec.RequestURI)
+	case ec.PathRegexp != nil:
+		return 1, 0
+	}
+	p := ec.Path
+	if ec.EscapedPath != "" {
+		p = ec.EscapedPath
+	}
+	if ec.ExactPath {
+		return 3, len(p)
+	}
+	return 2, len(p)
+}
+
+func (ec *ExpectedCall) matchMethod(r *http.Request) bool {
+	return ec.Method == AnyMethod || ec.Method == r.Method
+}
+
+func (ec *ExpectedCall) matchPath(r *http.Request) bool {
+	if ec.RequestURI != "" {
+		return r.RequestURI == ec.RequestURI
+	}
+	if ec.PathRegexp != nil {
+		return ec.PathRegexp.MatchString(r.URL.Path)
+	}
+	p, want := r.URL.Path, ec.Path
+	if ec.EscapedPath != "" {
+		p, want = r.URL.EscapedPath(), ec.EscapedPath
+	}
+	if ec.ExactPath {
+		return p == want
+	}
+	return strings.HasPrefix(p, want)
+}
+
+// containsValues reports whether every value in want is present in got.
+func containsValues(got, want map[string][]string) bool {
+	for k, vs := range want {
+		for _, v := range vs {
+			if !containsString(got[k], v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// containsHeader reports whether every value in want is present in got,
+// comparing keys case insensitively.
+func containsHeader(got, want http.Header) bool {
+	for k, vs := range want {
+		for _, v := range vs {
+			if !containsString(got.Values(k), v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchForm parses the url-encoded body of a copy of r, leaving r.Body
+// readable, and reports whether it contains want.
+func matchForm(r *http.Request, want url.Values) bool {
+	b, err := readBody(r)
+	if err != nil {
+		return false
+	}
+	c := r.Clone(r.Context())
+	c.Body = io.NopCloser(bytes.NewReader(b))
+	if err := c.ParseForm(); err != nil {
+		return false
+	}
+	return containsValues(c.PostForm, want)
+}
+
+// matchSHA256 hashes r.Body, restoring it, and compares it with digest.
+func matchSHA256(r *http.Request, digest string) bool {
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+	var buf bytes.Buffer
+	h := sha256.New()
+	_, err := io.Copy(h, io.TeeReader(r.Body, &buf))
+	r.Body = io.NopCloser(&buf)
+	return err == nil && hex.EncodeToString(h.Sum(nil)) == strings.ToLower(digest)
+}
+
+// maxSnippet is how much of a request body is shown in errors.
+const maxSnippet = 64
+
+// snippet quotes b, truncated to maxSnippet bytes.
+func snippet(b []byte) string {
+	if len(b) > maxSnippet {
+		return fmt.Sprintf("%q...", b[:maxSnippet])
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+func cloneValues(v url.Values) url.Values {
+	if v == nil {
+		return nil
+	}
+	c := make(url.Values, len(v))
+	for k, vs := range v {
+		c[k] = append([]string(nil), vs...)
+	}
+	return c
+}
+
+func (ec *ExpectedCall) hasTag(tag string) bool {
+	return containsString(ec.Tags, tag)
+}
+
+// ServeHTTP implements http.Handler
+func (ec *ExpectedCall) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ec.Delay > 0 && ec.sleep(r.Context(), ec.Delay) != nil {
+		return
+	}
+	n := ec.arrived()
+	if ec.ReadDelay > 0 && r.Body != nil {
+		r.Body = &delayedBody{ReadCloser: r.Body, ec: ec, ctx: r.Context()}
+	}
+
+	h := ec.Handler
+	if h == nil && len(ec.Handlers) > 0 {
+		if n >= len(ec.Handlers) {
+			n = len(ec.Handlers) - 1
+		}
+		h = ec.Handlers[n]
+	}
+	if h == nil && ec.HandlerFuncE != nil {
+		h = handlerFuncE(ec.HandlerFuncE)
+	}
+	if h == nil {
+		h = ec.notFound()
+	}
+	if ec.server != nil && ec.server.RequireBodyDrain && !ec.unexpected {
+		h = ec.server.requireDrain(h)
+	}
+	for i := len(ec.Middleware); i > 0; i-- {
+		h = ec.Middleware[i-1](h)
+	}
+	if ec.Gzip && headerHasToken(r.Header, "Accept-Encoding", "gzip") {
+		gw := &gzipResponseWriter{ResponseWriter: w, zw: gzip.NewWriter(w), rec: recorderFromContext(r.Context()), head: r.Method == "HEAD"}
+		if gw.rec != nil {
+			gw.rec.encoded = true
+		}
+		defer gw.close()
+		w = gw
+	}
+	h.ServeHTTP(w, r)
+	ec.Increment(-1)
+}
+
+// delayedBody waits for ReadDelay before its first read.
+type delayedBody struct {
+	io.ReadCloser
+	ec      *ExpectedCall
+	ctx     context.Context
+	started bool
+}
+
+func (b *delayedBody) Read(p []byte) (int, error) {
+	if !b.started {
+		b.started = true
+		if err := b.ec.sleep(b.ctx, b.ec.ReadDelay); err != nil {
+			return 0, err
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// fallbackWriter notes whether a fallback handler responded.
+type fallbackWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (fw *fallbackWriter) WriteHeader(code int) {
+	fw.wrote = true
+	fw.ResponseWriter.WriteHeader(code)
+}
+
+func (fw *fallbackWriter) Write(b []byte) (int, error) {
+	fw.wrote = true
+	return fw.ResponseWriter.Write(b)
+}
+
+func (fw *fallbackWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
+
+type handlerFuncE func(http.ResponseWriter, *http.Request) error
+
+func (f handlerFuncE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f(w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// arrived records the time of a call and returns how many calls arrived
+// before it.
+func (ec *ExpectedCall) arrived() int {
+	now := time.Now()
+	if ec.server != nil {
+		now = ec.server.now()
+	}
+
+	ec.m.Lock()
+	defer ec.m.Unlock()
+
+	ec.times = append(ec.times, now)
+	return len(ec.times) - 1
+}
+
+// requireDrain wraps h to warn if it leaves any of the request body unread.
+// Bodies already buffered by matching or middleware are measured from what
+// h was given.
+func (s *Server) requireDrain(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		body := r.Body
+		if db, ok := body.(*delayedBody); ok {
+			body = db.ReadCloser
+		}
+		if body == nil {
+			return
+		}
+		if unread, _ := io.Copy(io.Discard, body); unread > 0 {
+			s.warn("Server(%s) handler for %s %s left (%d) bytes of the request body unread",
+				s.Name, r.Method, r.URL.Path, unread)
+		}
+	})
+}
+
+// sleep waits for d using the owning server's Sleep, if any.
+func (ec *ExpectedCall) sleep(ctx context.Context, d time.Duration) error {
+	if ec.server != nil {
+		return ec.server.sleep(ctx, d)
+	}
+	return sleepContext(ctx, d)
+}
+
+// maxInWindow returns the most calls which arrived within any Window.
+func (ec *ExpectedCall) maxInWindow() int {
+	ec.m.Lock()
+	defer ec.m.Unlock()
+
+	if ec.Window <= 0 {
+		return 0
+	}
+	times := append([]time.Time(nil), ec.times...)
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	max := 0
+	for i, j := 0, 0; j < len(times); j++ {
+		for times[j].Sub(times[i]) >= ec.Window {
+			i++
+		}
+		if n := j - i + 1; n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+func (ec *ExpectedCall) remaining() int {
+	ec.m.Lock()
+	defer ec.m.Unlock()
+
+	return ec.Calls
+}
+
+// Satisfied reports whether ec has received all the calls it expects, so far.
+// Calls beyond that are still reported by Assert.
+func (ec *ExpectedCall) Satisfied() bool {
+	return ec.pendingCalls() <= 0
+}
+
+// pendingCalls returns how many more calls ec expects.
+func (ec *ExpectedCall) pendingCalls() int {
+	switch {
+	case ec.AnyTimes:
+		return 0
+	case ec.ranged():
+		return ec.MinCalls - ec.received()
+	}
+	return ec.remaining()
+}
+
+// ranged reports whether MinCalls or MaxCalls replace the Calls check.
+func (ec *ExpectedCall) ranged() bool {
+	return ec.MinCalls > 0 || ec.MaxCalls > 0
+}
+
+// received returns the number of calls which have arrived.
+func (ec *ExpectedCall) received() int {
+	ec.m.Lock()
+	defer ec.m.Unlock()
+
+	return len(ec.times)
+}
+
+// notFound returns the owning server's NotFoundHandler, falling back to the
+// package NotFound.
+func (ec *ExpectedCall) notFound() http.Handler {
+	if ec.server != nil && ec.server.NotFoundHandler != nil {
+		return ec.server.NotFoundHandler
+	}
+	return NotFound
+}
+
+// gzipResponseWriter compresses the response body, recording it uncompressed
+// in rec. Responses which can't have a body are passed through untouched.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	zw          *gzip.Writer
+	rec         *responseRecorder
+	head        bool
+	wroteHeader bool
+	plain       bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	// informational responses are followed by the real one
+	if !g.wroteHeader && code >= 200 {
+		g.wroteHeader = true
+		if g.head || code == http.StatusNoContent || code == http.StatusNotModified {
+			g.plain = true
+		} else {
+			g.Header().Set("Content-Encoding", "gzip")
+			g.Header().Del("Content-Length")
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.Header().Get("Content-Type") == "" {
+		g.Header().Set("Content-Type", http.DetectContentType(b))
+	}
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.rec != nil {
+		g.rec.body.Write(b)
+	}
+	if g.plain {
+		return g.ResponseWriter.Write(b)
+	}
+	return g.zw.Write(b)
+}
+
+// close finishes the compressed body, if one was started.
+func (g *gzipResponseWriter) close() {
+	if g.wroteHeader && !g.plain {
+		g.zw.Close()
+	}
+}
+
+// Flush writes any compressed data pending in zw before flushing the
+// underlying writer.
+func (g *gzipResponseWriter) Flush() {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.plain {
+		g.zw.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// bufferedResponseWriter holds the response until flush so its length is
+// known.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	buf      bytes.Buffer
+	hijacked bool
+}
+
+// Flush does nothing, the response is only written by flush.
+func (b *bufferedResponseWriter) Flush() {}
+
+func (b *bufferedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(b.ResponseWriter).Hijack()
+	if err == nil {
+		b.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (b *bufferedResponseWriter) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func (b *bufferedResponseWriter) flush() {
+	if b.hijacked {
+		return
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	h := b.Header()
+	h.Set("Connection", "close")
+	h.Set("Content-Length", strconv.Itoa(b.buf.Len()))
+	b.ResponseWriter.WriteHeader(b.status)
+	b.ResponseWriter.Write(b.buf.Bytes())
+}
+
+// strictResponseWriter warns about superfluous calls to WriteHeader.
+type strictResponseWriter struct {
+	http.ResponseWriter
+	s      *Server
+	r      *http.Request
+	status int
+	wrote  bool
+}
+
+func (sw *strictResponseWriter) WriteHeader(code int) {
+	switch {
+	case sw.status != 0:
+		sw.s.warn("Server(%s) handler for %s %s called WriteHeader (%d) after WriteHeader (%d)",
+			sw.s.Name, sw.r.Method, sw.r.URL.Path, code, sw.status)
+	case sw.wrote:
+		sw.s.warn("Server(%s) handler for %s %s called WriteHeader (%d) after Write",
+			sw.s.Name, sw.r.Method, sw.r.URL.Path, code)
+	default:
+		sw.status = code
+		sw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (sw *strictResponseWriter) Write(b []byte) (int, error) {
+	sw.wrote = true
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *strictResponseWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// warn adds a failure for Assert to report.
+func (s *Server) warn(format string, args ...interface{}) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.warnings = append(s.warnings, fmt.Sprintf(format, args...))
+}
+
+// Increment allows changing Calls in a thread-safe way.
+// use negative numbers to decrement.
+func (ec *ExpectedCall) Increment(i int) {
+	ec.m.Lock()
+	ec.Calls += i
+	ec.m.Unlock()
+
+	if ec.server != nil {
+		ec.server.signal()
+	}
 }
 
 // Middleware is a convenience type
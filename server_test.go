@@ -1,23 +1,50 @@
 package httpassert
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
 	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type helperT struct {
 	testing.TB
 
 	errors []string
+	m      sync.Mutex
 }
 
 func (t *helperT) Errorf(format string, args ...interface{}) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
 	t.errors = append(t.errors, fmt.Sprintf(format, args...))
 }
 
+// Errors returns the reported errors, for use when Errorf is called from
+// other goroutines.
+func (t *helperT) Errors() []string {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return append([]string(nil), t.errors...)
+}
+
 func (t *helperT) Helper() {}
 
 func assertResponse(t *testing.T, code int, r *http.Response, err error) bool {
@@ -104,6 +131,1560 @@ func TestServer(t *testing.T) {
 	})
 }
 
+func TestServerUnexpectedCalls(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+
+	for _, p := range []string{"/a", "/a/b", "/a", "/a"} {
+		r, err := http.Get(u + p)
+		assertResponse(t, 404, r, err)
+	}
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (3) unexpected calls to GET /a",
+		"Server(testserver) got (1) unexpected calls to GET /a/b",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerHonorMethodOverride(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.HonorMethodOverride = true
+	s.Expect(&ExpectedCall{Method: "DELETE", Path: "/users/1", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+
+	req, _ := http.NewRequest("POST", u+"/users/1", nil)
+	req.Header.Set("X-HTTP-Method-Override", "DELETE")
+	r, err := http.DefaultClient.Do(req)
+	assertResponse(t, 200, r, err)
+
+	req, _ = http.NewRequest("POST", u+"/users/1", nil)
+	req.Header.Set("X-HTTP-Method-Override", "TRACE")
+	r, err = http.DefaultClient.Do(req)
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to POST /users/1",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerMethodNotAllowed(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.MethodNotAllowed = true
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/users", Calls: 1, Handler: h})
+	s.Expect(&ExpectedCall{Method: "DELETE", Path: "/users", Calls: 0, Handler: h})
+
+	r, err := http.Post(u+"/users", "", nil)
+	assertResponse(t, 405, r, err)
+	if got, exp := r.Header.Get("Allow"), "DELETE, GET"; got != exp {
+		t.Errorf("Expected Allow header (%s), got (%s)", exp, got)
+	}
+	r, err = http.Post(u+"/other", "", nil)
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) expected (1) more calls to GET /users",
+		"Server(testserver) got (1) unexpected calls to POST /users",
+		"Server(testserver) got (1) unexpected calls to POST /other",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerAssertTag(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/login", Calls: 1, Handler: h, Tags: []string{"auth"}})
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/logout", Calls: 1, Handler: h, Tags: []string{"auth"}})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/invoices", Calls: 1, Handler: h, Tags: []string{"billing"}})
+
+	r, err := http.Post(u+"/login", "", nil)
+	assertResponse(t, 200, r, err)
+
+	if s.AssertTag(ht, "auth") {
+		t.Errorf("Expected s.AssertTag to not pass")
+	}
+	exp := []string{
+		"Server(testserver) expected (1) more calls to POST /logout",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestResetNotFound(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	defer ResetNotFound()
+
+	NotFound = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}
+	r, err := http.Get(u + "/missing")
+	assertResponse(t, 418, r, err)
+
+	ResetNotFound()
+	r, err = http.Get(u + "/missing")
+	assertResponse(t, 404, r, err)
+
+	s.Assert(new(helperT))
+}
+
+func TestExpectedCallHandlerFuncE(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/fail", Calls: 1, HandlerFuncE: func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("database unavailable")
+	}})
+
+	r, err := http.Get(u + "/fail")
+	assertResponse(t, 500, r, err)
+	b, _ := io.ReadAll(r.Body)
+	if got, exp := string(b), "database unavailable\n"; got != exp {
+		t.Errorf("Expected body (%q), got (%q)", exp, got)
+	}
+	s.Assert(t)
+}
+
+func TestServerAssertSubtests(t *testing.T) {
+	if os.Getenv("HTTPASSERT_SUBTESTS") == "1" {
+		var u string
+		s := New("testserver", &u)
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		s.Expect(&ExpectedCall{Method: "GET", Path: "/ok", Calls: 1, Handler: h})
+		s.Expect(&ExpectedCall{Method: "GET", Path: "/missed", Calls: 1, Handler: h})
+		http.Get(u + "/ok")
+		s.AssertSubtests(t)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestServerAssertSubtests$", "-test.v")
+	cmd.Env = append(os.Environ(), "HTTPASSERT_SUBTESTS=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Errorf("Expected subtests to fail")
+	}
+	for _, exp := range []string{
+		"--- PASS: TestServerAssertSubtests/GET_/ok",
+		"--- FAIL: TestServerAssertSubtests/GET_/missed",
+		"Server(testserver) expected (1) more calls to GET /missed",
+	} {
+		if !strings.Contains(string(out), exp) {
+			t.Errorf("Expected output to contain (%s), got\n%s", exp, out)
+		}
+	}
+}
+
+func TestServerSortErrors(t *testing.T) {
+	for _, paths := range [][]string{{"/b", "/a"}, {"/a", "/b"}} {
+		var u string
+		s := New("testserver", &u)
+		s.SortErrors = true
+		s.Expect(&ExpectedCall{Method: "PUT", Path: "/z", Calls: 1})
+		for _, p := range paths {
+			r, err := http.Get(u + p)
+			assertResponse(t, 404, r, err)
+		}
+
+		exp := []string{
+			"Server(testserver) got (1) unexpected calls to GET /a",
+			"Server(testserver) got (1) unexpected calls to GET /b",
+			"Server(testserver) expected (1) more calls to PUT /z",
+		}
+		assertExpectedCalls(t, exp, s.Check())
+	}
+}
+
+func TestServerDeadline(t *testing.T) {
+	var (
+		ht = &helperT{TB: t}
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/never", Calls: 1})
+	s.Deadline(ht, 10*time.Millisecond)
+
+	for i := 0; i < 100 && len(ht.Errors()) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	exp := []string{
+		"Server(testserver) deadline of 10ms exceeded, pending:\n\t(1) calls to GET /never",
+	}
+	assertExpectedCalls(t, exp, ht.Errors())
+}
+
+func TestServerDeadlineAfterCleanup(t *testing.T) {
+	ht := new(helperT)
+	s := New("testserver", nil)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/never", Calls: 1})
+
+	t.Run("finished", func(t *testing.T) {
+		ht.TB = t
+		s.Deadline(ht, 10*time.Millisecond)
+	})
+	time.Sleep(30 * time.Millisecond)
+
+	assertExpectedCalls(t, nil, ht.Errors())
+}
+
+func TestCloseAll(t *testing.T) {
+	Reset()
+
+	var urls []string
+	for _, name := range []string{"one", "two", "three"} {
+		urls = append(urls, New(name, nil).URL())
+	}
+	CloseAll()
+
+	if n := len(registered(false)); n != 0 {
+		t.Errorf("Expected no registered servers, got (%d)", n)
+	}
+	for _, u := range urls {
+		if _, err := http.Get(u); err == nil {
+			t.Errorf("Expected request to closed server %s to fail", u)
+		}
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			New("testserver", nil).Close()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWithTimeout(t *testing.T) {
+	ht := new(helperT)
+	Reset()
+
+	s := New("testserver", nil)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/never", Calls: 1})
+
+	block := make(chan struct{})
+	defer close(block)
+	WithTimeout(ht, 10*time.Millisecond, func() { <-block })
+
+	exp := []string{
+		"Server(testserver) timeout of 10ms exceeded, pending:\n\t(1) calls to GET /never",
+		"Server(testserver) expected (1) more calls to GET /never",
+	}
+	assertExpectedCalls(t, exp, ht.Errors())
+	if n := len(registered(false)); n != 0 {
+		t.Errorf("Expected servers to be closed, got (%d) registered", n)
+	}
+
+	ht = new(helperT)
+	WithTimeout(ht, time.Second, func() {})
+	assertExpectedCalls(t, nil, ht.Errors())
+}
+
+func TestServerWaitFor(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.On("POST", "/events").Times(2)
+
+	if s.WaitFor(10 * time.Millisecond) {
+		t.Errorf("Expected s.WaitFor to time out")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		for i := 0; i < 2; i++ {
+			http.Post(u+"/events", "", nil)
+		}
+	}()
+	if !s.WaitFor(time.Second) {
+		t.Errorf("Expected s.WaitFor to return once calls arrived")
+	}
+	s.Assert(t)
+}
+
+func TestExpectedCallClone(t *testing.T) {
+	ec := &ExpectedCall{
+		Method:   "GET",
+		Path:     "/users",
+		Calls:    2,
+		Matchers: []Matcher{WithContentEncoding("gzip")},
+		Tags:     []string{"users"},
+	}
+	c := ec.Clone()
+	if c.Method != "GET" || c.Path != "/users" || len(c.Matchers) != 1 || c.Calls != 0 {
+		t.Errorf("Expected clone of GET /users with (1) matcher and (0) calls, got %s %s (%d) (%d)", c.Method, c.Path, len(c.Matchers), c.Calls)
+	}
+
+	c.Path = "/admins"
+	c.Tags[0] = "admins"
+	c.Matchers = append(c.Matchers, WithUpgrade("websocket"))
+	c.Increment(1)
+
+	if ec.Path != "/users" || ec.Tags[0] != "users" || len(ec.Matchers) != 1 || ec.Calls != 2 {
+		t.Errorf("Expected original to be unchanged, got %s %v (%d) (%d)", ec.Path, ec.Tags, len(ec.Matchers), ec.Calls)
+	}
+}
+
+func TestServerHandle(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	auth := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	s.Handle("GET", "/private", []Middleware{auth}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 2)
+
+	r, err := http.Get(u + "/private")
+	assertResponse(t, 401, r, err)
+
+	req, _ := http.NewRequest("GET", u+"/private", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	r, err = http.DefaultClient.Do(req)
+	assertResponse(t, 200, r, err)
+
+	if !s.Assert(ht) {
+		t.Errorf("Expected s.Assert to pass")
+	}
+	assertExpectedCalls(t, nil, ht.errors)
+}
+
+func TestExpectedCallWindow(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	now := time.Unix(0, 0)
+	s.Now = func() time.Time { return now }
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/poll", Calls: 4, Handler: h, Window: time.Second, WindowCalls: 2})
+
+	for _, d := range []time.Duration{0, time.Second, 1500 * time.Millisecond, 1900 * time.Millisecond} {
+		now = time.Unix(0, 0).Add(d)
+		r, err := http.Get(u + "/poll")
+		assertResponse(t, 200, r, err)
+	}
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (3) calls to GET /poll within 1s, expected at most (2)",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallRequestURI(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/search", RequestURI: "/search?q=a%20b", Calls: 1, Handler: h})
+
+	r, err := http.Get(u + "/search?q=a%20b")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/search?q=a+b")
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to GET /search",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallGzip(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/compressed", Calls: 1, Handler: h, Gzip: true})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/plain", Calls: 1, Handler: h})
+
+	for _, tc := range []struct {
+		path         string
+		uncompressed bool
+	}{{"/compressed", true}, {"/plain", false}} {
+		r, err := http.Get(u + tc.path)
+		assertResponse(t, 200, r, err)
+		b, _ := io.ReadAll(r.Body)
+		if string(b) != "hello" {
+			t.Errorf("Expected %s body (hello), got (%s)", tc.path, b)
+		}
+		if r.Uncompressed != tc.uncompressed {
+			t.Errorf("Expected %s to be compressed (%t), got (%t)", tc.path, tc.uncompressed, r.Uncompressed)
+		}
+	}
+	s.Assert(t)
+}
+
+func TestExpectedCallGzipHeaders(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/length", Calls: 1, Gzip: true, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	})})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/empty", Calls: 1, Gzip: true, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})})
+	s.Expect(&ExpectedCall{Method: "HEAD", Path: "/length", Calls: 1, Gzip: true, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.WriteHeader(http.StatusOK)
+	})})
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		body         string
+		compressed   bool
+	}{
+		{"GET", "/length", 200, "hello", true},
+		{"GET", "/empty", 204, "", false},
+		{"HEAD", "/length", 200, "", false},
+	} {
+		req, _ := http.NewRequest(tc.method, u+tc.path, nil)
+		if tc.method == "HEAD" {
+			// the Transport only asks for gzip itself on other methods
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		r, err := http.DefaultClient.Do(req)
+		assertResponse(t, tc.status, r, err)
+		b, err := io.ReadAll(r.Body)
+		assertNoError(t, err)
+		if string(b) != tc.body {
+			t.Errorf("Expected %s %s body (%s), got (%s)", tc.method, tc.path, tc.body, b)
+		}
+		if compressed := r.Uncompressed || r.Header.Get("Content-Encoding") != ""; compressed != tc.compressed {
+			t.Errorf("Expected %s %s to be compressed (%t), got (%t)", tc.method, tc.path, tc.compressed, compressed)
+		}
+	}
+	s.Assert(t)
+}
+
+func TestExpectedCallGzipRecorded(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: h, Gzip: true})
+
+	r, err := http.Get(u)
+	assertResponse(t, 200, r, err)
+	if !r.Uncompressed {
+		t.Errorf("Expected response to be compressed")
+	}
+
+	s.AssertJSONResponse(t, 0, map[string]bool{"ok": true})
+	s.AssertResponsesValidJSON(t)
+	s.Assert(t)
+}
+
+func TestExpectedCallGzipFlush(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	release := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		http.NewResponseController(w).Flush()
+		<-release
+	})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: h, Gzip: true})
+
+	r, err := http.Get(u)
+	assertResponse(t, 200, r, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(r.Body, b)
+	close(release)
+	if err != nil || string(b) != "hello" {
+		t.Errorf("Expected flushed body (hello), got (%s) %v", b, err)
+	}
+	io.Copy(io.Discard, r.Body)
+	r.Body.Close()
+	s.Assert(t)
+}
+
+func TestServerAsserted(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/a", Calls: 1})
+
+	if s.Asserted() {
+		t.Errorf("Expected s.Asserted to be false")
+	}
+	if s.Assert(ht) {
+		t.Errorf("Expected s.Assert to not pass")
+	}
+	if !s.Asserted() {
+		t.Errorf("Expected s.Asserted to be true")
+	}
+	if s.Assert(ht) {
+		t.Errorf("Expected s.Assert to not pass")
+	}
+	r, err := http.Get(u + "/b")
+	assertResponse(t, 404, r, err)
+	s.Assert(ht)
+
+	exp := []string{
+		"Server(testserver) expected (1) more calls to GET /a",
+		"Server(testserver) got (1) unexpected calls to GET /b",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+
+	// another t is told about failures already reported elsewhere
+	ht2 := new(helperT)
+	s.Assert(ht2)
+	assertExpectedCalls(t, exp, ht2.errors)
+}
+
+func TestExpectedCallBodySHA256(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	body := bytes.Repeat([]byte("0123456789"), 1<<20)
+	sum := sha256.Sum256(body)
+	var n int
+	s.Expect(&ExpectedCall{Method: "PUT", Path: "/blob", Calls: 1, BodySHA256: hex.EncodeToString(sum[:]), Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		n = len(b)
+	})})
+
+	req, _ := http.NewRequest("PUT", u+"/blob", bytes.NewReader(body))
+	r, err := http.DefaultClient.Do(req)
+	assertResponse(t, 200, r, err)
+	if n != len(body) {
+		t.Errorf("Expected handler to read (%d) bytes, got (%d)", len(body), n)
+	}
+
+	req, _ = http.NewRequest("PUT", u+"/blob", bytes.NewReader(body[1:]))
+	r, err = http.DefaultClient.Do(req)
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		`Server(testserver) got (1) unexpected calls to PUT /blob, first with body "1234567890123456789012345678901234567890123456789012345678901234"...`,
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallForm(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	var name string
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/users", Calls: 1,
+		Form: url.Values{"role": {"admin"}},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name = r.FormValue("name")
+		}),
+	})
+
+	r, err := http.PostForm(u+"/users", url.Values{"name": {"alice"}, "role": {"admin"}})
+	assertResponse(t, 200, r, err)
+	if name != "alice" {
+		t.Errorf("Expected handler to read name (alice), got (%s)", name)
+	}
+
+	r, err = http.Post(u+"/users?role=admin", "application/x-www-form-urlencoded", strings.NewReader("name=bob&role=user"))
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		`Server(testserver) got (1) unexpected calls to POST /users, first with body "name=bob&role=user"`,
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallBodyMatchFunc(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	var got string
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/import", Calls: 1,
+		BodyMatchFunc: func(body []byte) bool {
+			return bytes.HasPrefix(body, []byte("id,name\n"))
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			got = string(b)
+		}),
+	})
+
+	csv := "id,name\n1,alice\n"
+	r, err := http.Post(u+"/import", "text/csv", strings.NewReader(csv))
+	assertResponse(t, 200, r, err)
+	if got != csv {
+		t.Errorf("Expected handler to read (%s), got (%s)", csv, got)
+	}
+
+	r, err = http.Post(u+"/import", "text/csv", strings.NewReader("name,id\nalice,1\n"))
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		`Server(testserver) got (1) unexpected calls to POST /import, first with body "name,id\nalice,1\n"`,
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerForceHTTP10(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.ForceHTTP10 = true
+	body := bytes.Repeat([]byte("a"), 64*1024)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		for i := 0; i < len(body); i += 1024 {
+			w.Write(body[i : i+1024])
+		}
+	})})
+
+	r, err := http.Get(u)
+	assertResponse(t, 202, r, err)
+	if len(r.TransferEncoding) != 0 {
+		t.Errorf("Expected no Transfer-Encoding, got (%v)", r.TransferEncoding)
+	}
+	if r.ContentLength != int64(len(body)) {
+		t.Errorf("Expected Content-Length (%d), got (%d)", len(body), r.ContentLength)
+	}
+	if !r.Close {
+		t.Errorf("Expected connection to close")
+	}
+	b, _ := io.ReadAll(r.Body)
+	if !bytes.Equal(b, body) {
+		t.Errorf("Expected body of (%d) bytes, got (%d)", len(body), len(b))
+	}
+	s.Assert(t)
+}
+
+func TestServerAssertCall(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	create := s.On("POST", "/orders").Respond(201, "")
+	s.On("GET", "/orders").Times(2)
+
+	if create.Satisfied() {
+		t.Errorf("Expected POST /orders to not be satisfied before any calls")
+	}
+	r, err := http.Post(u+"/orders", "", nil)
+	assertResponse(t, 201, r, err)
+
+	if !create.Satisfied() {
+		t.Errorf("Expected POST /orders to be satisfied")
+	}
+	if !s.AssertCall(ht, "POST", "/orders") {
+		t.Errorf("Expected s.AssertCall to pass")
+	}
+	if s.AssertCall(ht, "GET", "/orders") {
+		t.Errorf("Expected s.AssertCall to not pass")
+	}
+	if s.AssertCall(ht, "DELETE", "/orders") {
+		t.Errorf("Expected s.AssertCall to not pass")
+	}
+	exp := []string{
+		"Server(testserver) expected GET /orders to be satisfied, (2) calls pending",
+		"Server(testserver) has no expectation for DELETE /orders",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerAssertOrder(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/items", Calls: 1, Handler: h})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/items", Calls: 2, Handler: h})
+	s.Expect(&ExpectedCall{Method: "DELETE", Path: "/items", Calls: 1, Handler: h})
+
+	http.Post(u+"/items", "", nil)
+	http.Get(u + "/items")
+	http.Get(u + "/other")
+	if !s.AssertOrder(ht) {
+		t.Errorf("Expected s.AssertOrder to pass")
+	}
+
+	req, _ := http.NewRequest("DELETE", u+"/items", nil)
+	http.DefaultClient.Do(req)
+	http.Get(u + "/items")
+
+	if s.AssertOrder(ht) {
+		t.Errorf("Expected s.AssertOrder to not pass")
+	}
+	exp := []string{
+		"Server(testserver) got GET /items (step 2) after DELETE /items (step 3)",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerInOrder(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	create := &ExpectedCall{Method: "POST", Path: "/items", Calls: 1, Handler: h}
+	update := &ExpectedCall{Method: "PATCH", Path: "/items", Calls: 1, Handler: h}
+	s.Expect(create)
+	s.Expect(update)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/status", Calls: 1, Handler: h})
+	s.InOrder(create, update)
+
+	http.Get(u + "/status")
+	req, _ := http.NewRequest("PATCH", u+"/items", nil)
+	http.DefaultClient.Do(req)
+	http.Post(u+"/items", "", nil)
+
+	if s.Assert(ht) {
+		t.Errorf("Expected s.Assert to not pass")
+	}
+	exp := []string{
+		"Server(testserver) got POST /items (step 1) after PATCH /items (step 2)",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerMerge(t *testing.T) {
+	var (
+		ht     = new(helperT)
+		u, u2  string
+		tagged bool
+	)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	users := func() *Server {
+		s := New("users", &u2)
+		s.Expect(&ExpectedCall{Method: "GET", Path: "/users", Calls: 1, Handler: h})
+		s.Use(func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tagged = true
+				h.ServeHTTP(w, r)
+			})
+		})
+		return s
+	}
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/groups", Calls: 1, Handler: h})
+	s.Merge(users())
+
+	var got []string
+	for _, ec := range s.ExpectedCalls {
+		got = append(got, ec.Method+" "+ec.Path)
+	}
+	assertExpectedCalls(t, []string{"GET /groups", "GET /users"}, got)
+
+	if _, err := http.Get(u2 + "/users"); err == nil {
+		t.Errorf("Expected merged server to be closed")
+	}
+	r, err := http.Get(u + "/users")
+	assertResponse(t, 200, r, err)
+	if !tagged {
+		t.Errorf("Expected merged middleware to run")
+	}
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) expected (1) more calls to GET /groups",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerMergeAssert(t *testing.T) {
+	ht := new(helperT)
+	Reset()
+
+	a := New("a", nil)
+	b := New("b", nil)
+	b.Expect(&ExpectedCall{Method: "GET", Path: "/x", Calls: 1})
+	a.Merge(b)
+
+	if len(b.ExpectedCalls) != 0 {
+		t.Errorf("Expected merged server to have no expectations, got (%d)", len(b.ExpectedCalls))
+	}
+	Assert(ht)
+	exp := []string{
+		"Server(a) expected (1) more calls to GET /x",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestNewNilURL(t *testing.T) {
+	s := New("x", nil)
+	defer s.Close()
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+
+	r, err := http.Get(s.URL())
+	assertResponse(t, 200, r, err)
+	s.Assert(t)
+}
+
+func TestServerPause(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+	c := &http.Client{Timeout: 20 * time.Millisecond}
+
+	s.Pause()
+	if _, err := c.Get(u); err == nil {
+		t.Errorf("Expected request to time out while paused")
+	}
+	// give the server time to notice the client went away
+	time.Sleep(50 * time.Millisecond)
+
+	s.Resume()
+	r, err := c.Get(u)
+	assertResponse(t, 200, r, err)
+	s.Assert(t)
+}
+
+func TestServerClosePaused(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+	arrived := make(chan struct{}, 1)
+	s.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			arrived <- struct{}{}
+			h.ServeHTTP(w, r)
+		})
+	})
+
+	s.Pause()
+	go func() {
+		if r, err := http.Get(u); err == nil {
+			r.Body.Close()
+		}
+	}()
+	<-arrived
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected Close to release paused requests")
+	}
+	if n := len(s.Recorded()); n != 0 {
+		t.Errorf("Expected paused request to be dropped, got (%d) recorded", n)
+	}
+}
+
+func TestExpectedCallEscapedPath(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/files/a/b", EscapedPath: "/files/a%2Fb", Calls: 1, Handler: h})
+
+	r, err := http.Get(u + "/files/a%2Fb")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/files/a/b")
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to GET /files/a/b",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerCleanPaths(t *testing.T) {
+	var (
+		u     string
+		paths []string
+	)
+	s := New("testserver", &u)
+	s.CleanPaths = true
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/a/b", Calls: 2, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	})})
+
+	for _, p := range []string{"/a//b", "/a/./b"} {
+		req, _ := http.NewRequest("GET", u, nil)
+		req.URL.Opaque = p
+		r, err := http.DefaultClient.Do(req)
+		assertResponse(t, 200, r, err)
+	}
+
+	assertExpectedCalls(t, []string{"/a//b", "/a/./b"}, paths)
+	s.Assert(t)
+
+	t.Run("trailing slash", func(t *testing.T) {
+		var u string
+		s := New("testserver", &u)
+		s.CleanPaths = true
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		s.Expect(&ExpectedCall{Method: "GET", Path: "/users/", ExactPath: true, Calls: 2, Handler: h})
+
+		for _, p := range []string{"/users/", "/users//"} {
+			req, _ := http.NewRequest("GET", u, nil)
+			req.URL.Opaque = p
+			r, err := http.DefaultClient.Do(req)
+			assertResponse(t, 200, r, err)
+		}
+		s.Assert(t)
+	})
+}
+
+func TestExpectedCallExactPath(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/users/123", ExactPath: true, Calls: 1, Handler: h})
+
+	r, err := http.Get(u + "/users/123")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/users/123/extra")
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to GET /users/123/extra",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallPathRegexp(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/users/{id}/profile", PathRegexp: regexp.MustCompile(`^/users/\d+/profile$`), Calls: 1, Handler: h})
+
+	r, err := http.Get(u + "/users/42/profile")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/users/abc/profile")
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to GET /users/abc/profile",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallQuery(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := func(code int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(code) })
+	}
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/items", Query: url.Values{"page": {"1"}}, Calls: 1, Handler: h(201)})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/items", Query: url.Values{"page": {"2"}}, Calls: 1, Handler: h(202)})
+
+	r, err := http.Get(u + "/items?page=2&sort=asc")
+	assertResponse(t, 202, r, err)
+	r, err = http.Get(u + "/items?page=1")
+	assertResponse(t, 201, r, err)
+	r, err = http.Get(u + "/items")
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to GET /items",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallHeader(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	h := func(code int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(code) })
+	}
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/doc", Header: http.Header{"Accept": {"application/json"}}, Calls: 1, Handler: h(201)})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/doc", Header: http.Header{"accept": {"application/xml"}}, Calls: 1, Handler: h(202)})
+
+	for _, tc := range []struct {
+		accept string
+		code   int
+	}{{"application/xml", 202}, {"application/json", 201}} {
+		req, _ := http.NewRequest("GET", u+"/doc", nil)
+		req.Header.Set("Accept", tc.accept)
+		req.Header.Set("X-Api-Version", "2")
+		r, err := http.DefaultClient.Do(req)
+		assertResponse(t, tc.code, r, err)
+	}
+	s.Assert(t)
+}
+
+func TestExpectedCallMatchFunc(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/tenants/", Calls: 1, Handler: h, MatchFunc: func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/tenants/") && r.Header.Get("X-Tenant") == "acme"
+	}})
+
+	req, _ := http.NewRequest("PUT", u+"/tenants/acme", nil)
+	req.Header.Set("X-Tenant", "acme")
+	r, err := http.DefaultClient.Do(req)
+	assertResponse(t, 200, r, err)
+
+	req, _ = http.NewRequest("PUT", u+"/tenants/acme", nil)
+	req.Header.Set("X-Tenant", "globex")
+	r, err = http.DefaultClient.Do(req)
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to PUT /tenants/acme",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerConcurrentRequests(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/a", Calls: 17, Handler: h})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/b", Calls: 17, Handler: h})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := []string{"/a", "/b", "/c"}[i%3]
+			if r, err := http.Get(u + p); err == nil {
+				r.Body.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (16) unexpected calls to GET /c",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallTolerance(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/flaky", Calls: 1, Tolerance: 1, Handler: h})
+	s.Expect(&ExpectedCall{Method: "POST", Path: "/strict", Calls: 1, Handler: h})
+
+	for i := 0; i < 2; i++ {
+		http.Post(u+"/flaky", "", nil)
+		http.Post(u+"/strict", "", nil)
+	}
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to POST /strict",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallMinMaxCalls(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/under", MinCalls: 3, Handler: h})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/over", MinCalls: 1, MaxCalls: 2, Handler: h})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/within", MinCalls: 1, MaxCalls: 3, Handler: h})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/unbounded", MinCalls: 1, Handler: h})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/any", AnyTimes: true, Handler: h})
+
+	get := func(path string, n int) {
+		for i := 0; i < n; i++ {
+			r, err := http.Get(u + path)
+			assertResponse(t, 200, r, err)
+		}
+	}
+	get("/under", 2)
+	get("/over", 3)
+	get("/within", 2)
+	get("/unbounded", 10)
+	get("/any", 4)
+
+	exp := []string{
+		"(1) calls to GET /under",
+	}
+	assertExpectedCalls(t, exp, s.pending())
+
+	s.Assert(ht)
+	exp = []string{
+		"Server(testserver) expected at least (3) calls to GET /under, got (2)",
+		"Server(testserver) expected at most (2) calls to GET /over, got (3)",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallAnyMethod(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	ec := &ExpectedCall{Method: AnyMethod, Path: "/cors", Calls: 3, Handler: RespondStatus(204)}
+	s.Expect(ec)
+
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		req, _ := http.NewRequest(method, u+"/cors", nil)
+		r, err := http.DefaultClient.Do(req)
+		assertResponse(t, 204, r, err)
+	}
+
+	if n := ec.remaining(); n != 0 {
+		t.Errorf("Expected (0) remaining calls, got (%d)", n)
+	}
+	if !s.Assert(ht) {
+		t.Errorf("Expected s.Assert to pass, got %v", ht.errors)
+	}
+}
+
+func TestExpectedCallHandlers(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/job", Calls: 4, Handlers: []http.Handler{
+		RespondStatus(202),
+		RespondStatus(503),
+		RespondStatus(200),
+	}})
+
+	for _, code := range []int{202, 503, 200, 200} {
+		r, err := http.Get(u + "/job")
+		assertResponse(t, code, r, err)
+	}
+
+	if !s.Assert(ht) {
+		t.Errorf("Expected s.Assert to pass, got %v", ht.errors)
+	}
+}
+
+func TestExpectedCallDelay(t *testing.T) {
+	var (
+		ht     = new(helperT)
+		u      string
+		served int32
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/slow", Calls: 1, Delay: 50 * time.Millisecond,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&served, 1)
+		}),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", u+"/slow", nil)
+	if _, err := http.DefaultClient.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+
+	for i := 0; i < 100 && len(s.Recorded()) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&served); n != 0 {
+		t.Errorf("Expected handler not to be called, got (%d) calls", n)
+	}
+	if calls := s.Recorded(); len(calls) != 1 || calls[0].StatusCode != 0 {
+		t.Errorf("Expected (1) recorded call without a status")
+	}
+	if counts := s.StatusCounts(); len(counts) != 0 {
+		t.Errorf("Expected no status counts, got %v", counts)
+	}
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) expected (1) more calls to GET /slow",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerUnexpectedCallBody(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+
+	r, err := http.Post(u+"/endpoint", "application/json", strings.NewReader(`{"name":"alice"}`))
+	assertResponse(t, 404, r, err)
+	r, err = http.Post(u+"/endpoint", "application/json", strings.NewReader(`{"name":"bob"}`))
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		`Server(testserver) got (2) unexpected calls to POST /endpoint, first with body "{\"name\":\"alice\"}"`,
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerRoutes(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	ecs := s.Routes(map[string]http.Handler{
+		"/health":      RespondStatus(204),
+		"/config":      RespondStatus(200),
+		"POST /events": RespondStatus(202),
+	})
+	if len(ecs) != 3 || ecs[0].Path != "/config" || ecs[2].Method != "POST" {
+		t.Errorf("Expected routes registered in key order")
+	}
+
+	r, err := http.Get(u + "/health")
+	assertResponse(t, 204, r, err)
+	r, err = http.Post(u+"/health", "", nil)
+	assertResponse(t, 204, r, err)
+	r, err = http.Get(u + "/config")
+	assertResponse(t, 200, r, err)
+	r, err = http.Post(u+"/events", "", nil)
+	assertResponse(t, 202, r, err)
+	r, err = http.Get(u + "/events")
+	assertResponse(t, 404, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to GET /events",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestExpectedCallReadDelay(t *testing.T) {
+	var (
+		u    string
+		read = make(chan time.Duration, 1)
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "PUT", Path: "/upload", Calls: 1, ReadDelay: 100 * time.Millisecond,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			io.ReadAll(r.Body)
+			read <- time.Since(start)
+		}),
+	})
+
+	c := &http.Client{Timeout: 20 * time.Millisecond}
+	req, _ := http.NewRequest("PUT", u+"/upload", strings.NewReader("chunk"))
+	if _, err := c.Do(req); err == nil {
+		t.Errorf("Expected client to time out")
+	}
+
+	select {
+	case d := <-read:
+		if d < 10*time.Millisecond {
+			t.Errorf("Expected body read to be delayed, took %s", d)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected handler to read the body")
+	}
+}
+
+func TestServerMatchSpecificity(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1, Handler: RespondStatus(200)})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/users/:id", PathRegexp: regexp.MustCompile(`^/users/\d+$`), Calls: 1, Handler: RespondStatus(203)})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/users", Calls: 1, Handler: RespondStatus(201)})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/users/me", ExactPath: true, Calls: 1, Handler: RespondStatus(202)})
+
+	for path, code := range map[string]int{
+		"/":          200,
+		"/users/1":   201,
+		"/users/me":  202,
+		"/users/me/": 201,
+	} {
+		r, err := http.Get(u + path)
+		assertResponse(t, code, r, err)
+	}
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) expected (1) more calls to GET /users/:id",
+		"Server(testserver) got (1) unexpected calls to GET /users",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerNotFoundHandler(t *testing.T) {
+	var u1, u2 string
+	s1 := New("one", &u1)
+	s1.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	s2 := New("two", &u2)
+	s2.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	s3 := New("three", nil)
+
+	r, err := http.Get(u1)
+	assertResponse(t, 500, r, err)
+	r, err = http.Get(u2)
+	assertResponse(t, 410, r, err)
+	r, err = http.Get(s3.URL())
+	assertResponse(t, 404, r, err)
+}
+
+func TestServerFallbacks(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	var declined int
+	s.Fallbacks = []http.Handler{
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			declined++
+		}),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/canned" {
+				w.WriteHeader(http.StatusTeapot)
+			}
+		}),
+	}
+
+	r, err := http.Get(u + "/canned")
+	assertResponse(t, 418, r, err)
+	r, err = http.Get(u + "/missing")
+	assertResponse(t, 404, r, err)
+
+	if declined != 2 {
+		t.Errorf("Expected first fallback to decline (2) calls, got (%d)", declined)
+	}
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) got (1) unexpected calls to GET /missing",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerStrictResponses(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := New("testserver", &u)
+	s.StrictResponses = true
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/twice", Calls: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.WriteHeader(http.StatusInternalServerError)
+		}),
+	})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/late", Calls: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+			w.WriteHeader(http.StatusInternalServerError)
+		}),
+	})
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/fine", Calls: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte("ok"))
+		}),
+	})
+
+	r, err := http.Get(u + "/twice")
+	assertResponse(t, 201, r, err)
+	r, err = http.Get(u + "/late")
+	assertResponse(t, 200, r, err)
+	r, err = http.Get(u + "/fine")
+	assertResponse(t, 202, r, err)
+
+	s.Assert(ht)
+	exp := []string{
+		"Server(testserver) handler for GET /twice called WriteHeader (500) after WriteHeader (201)",
+		"Server(testserver) handler for GET /late called WriteHeader (500) after Write",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+}
+
+func TestServerResponseMiddleware(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.ResponseMiddleware = func(w http.ResponseWriter) http.ResponseWriter {
+		w.Header().Set("X-Mock", "true")
+		return w
+	}
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/a", Calls: 1, Handler: RespondStatus(204)})
+
+	for path, code := range map[string]int{"/a": 204, "/missing": 404} {
+		r, err := http.Get(u + path)
+		assertResponse(t, code, r, err)
+		if got := r.Header.Get("X-Mock"); got != "true" {
+			t.Errorf("Expected X-Mock header on %s, got (%s)", path, got)
+		}
+	}
+}
+
+func TestNewTLS(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	s := NewTLS("testserver", &u)
+	defer s.Close()
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/secure", Calls: 1, Handler: RespondStatus(204)})
+
+	if !strings.HasPrefix(u, "https://") {
+		t.Errorf("Expected an https URL, got (%s)", u)
+	}
+	r, err := s.Client().Get(u + "/secure")
+	assertResponse(t, 204, r, err)
+	if r.TLS == nil {
+		t.Errorf("Expected response over TLS")
+	}
+
+	if !s.Assert(ht) {
+		t.Errorf("Expected s.Assert to pass, got %v", ht.errors)
+	}
+}
+
+func TestServerPassthrough(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "real")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+
+	s := New("testserver", &u)
+	s.Passthrough, _ = url.Parse(backend.URL)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/mocked", Calls: 1, Handler: RespondStatus(202)})
+
+	r, err := http.Get(u + "/mocked")
+	assertResponse(t, 202, r, err)
+	if got := r.Header.Get("X-Backend"); got != "" {
+		t.Errorf("Expected mocked response, got X-Backend (%s)", got)
+	}
+
+	r, err = http.Get(u + "/real")
+	assertResponse(t, 200, r, err)
+	b, _ := io.ReadAll(r.Body)
+	if got := r.Header.Get("X-Backend"); got != "real" || string(b) != "/real" {
+		t.Errorf("Expected proxied response for /real, got X-Backend (%s) body (%s)", got, b)
+	}
+
+	if !s.Assert(ht) {
+		t.Errorf("Expected s.Assert to pass, got %v", ht.errors)
+	}
+}
+
+func TestNewT(t *testing.T) {
+	var (
+		ht = new(helperT)
+		u  string
+	)
+	t.Run("cleanup", func(t *testing.T) {
+		ht.TB = t
+		var s *Server
+		s, u = NewT(ht, "testserver")
+		s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1})
+	})
+
+	exp := []string{
+		"Server(testserver) expected (1) more calls to GET /",
+	}
+	assertExpectedCalls(t, exp, ht.errors)
+	if _, err := http.Get(u); err == nil {
+		t.Errorf("Expected listener to be closed")
+	}
+}
+
+func TestReset(t *testing.T) {
+	ht := new(helperT)
+	Reset()
+
+	closed := New("closed", nil)
+	closed.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1})
+	closed.Close()
+
+	New("stale", nil).Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1})
+	Reset()
+
+	if !Assert(ht) {
+		t.Errorf("Expected Assert to pass")
+	}
+	if len(ht.Errors()) != 0 {
+		t.Errorf("Expected no errors, got %v", ht.Errors())
+	}
+}
+
 func ExampleExpectedCall() {
 	var t *testing.T
 	var s *Server
@@ -0,0 +1,16 @@
+//go:build testify
+
+package httpassert
+
+import "github.com/stretchr/testify/require"
+
+// Require runs s.Check and fails t through require, stopping the test, if
+// there were any failures. It is only built with the testify build tag so the
+// core package doesn't depend on testify.
+func Require(t require.TestingT, s *Server) {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	errs := s.Check()
+	require.Emptyf(t, errs, "Server(%s) assertions failed", s.Name)
+}
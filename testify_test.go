@@ -0,0 +1,43 @@
+//go:build testify
+
+package httpassert
+
+import (
+	"fmt"
+	"testing"
+)
+
+type requireT struct {
+	errors []string
+	failed bool
+}
+
+func (t *requireT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *requireT) FailNow() {
+	t.failed = true
+}
+
+func TestRequire(t *testing.T) {
+	var u string
+	s := New("testserver", &u)
+	s.Expect(&ExpectedCall{Method: "GET", Path: "/", Calls: 1})
+
+	rt := new(requireT)
+	Require(rt, s)
+	if !rt.failed {
+		t.Errorf("Expected Require to fail the test")
+	}
+	if len(rt.errors) != 1 {
+		t.Errorf("Expected (1) error, got (%d)", len(rt.errors))
+	}
+
+	rt = new(requireT)
+	s.ExpectedCalls[0].Increment(-1)
+	Require(rt, s)
+	if rt.failed {
+		t.Errorf("Expected Require to pass, got %v", rt.errors)
+	}
+}